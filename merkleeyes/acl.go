@@ -0,0 +1,153 @@
+package merkleeyes
+
+import (
+	"fmt"
+
+	"github.com/cosmos/iavl"
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+)
+
+// Keys under a prefix with an ACL can only be written by the prefix's owners,
+// i.e. by transactions signed by one of them. A key is governed by the longest
+// prefix with an ACL. The owners are stored as a set of pubkeys (see list.go).
+
+// aclKey maps a key prefix to its owners.
+func aclKey(prefix []byte) []byte {
+	return append([]byte("/acl/"), prefix...)
+}
+
+// getOwners returns the owners of exactly the given prefix, or nil if it has
+// no ACL.
+func getOwners(tree *iavl.ImmutableTree, prefix []byte) [][]byte {
+	_, bz := tree.Get(aclKey(prefix))
+	if bz == nil {
+		return nil
+	}
+	owners, err := decodeSet(bz)
+	if err != nil {
+		panic(fmt.Sprintf("corrupted ACL of %X: %v", prefix, err))
+	}
+	return owners
+}
+
+// governingOwners returns the owners of the longest prefix of key which has
+// an ACL, or nil if there is none.
+func governingOwners(tree *iavl.ImmutableTree, key []byte) (prefix []byte, owners [][]byte) {
+	for i := len(key); i > 0; i-- {
+		if owners := getOwners(tree, key[:i]); owners != nil {
+			return key[:i], owners
+		}
+	}
+	return nil, nil
+}
+
+func isOwner(owners [][]byte, signer ed25519.PubKey) bool {
+	if signer == nil {
+		return false
+	}
+	for _, o := range owners {
+		if signer.Equals(ed25519.PubKey(o)) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks that signer (nil for unsigned transactions) may write all
+// the given keys.
+func authorize(tree *iavl.MutableTree, signer ed25519.PubKey, keys ...[]byte) abci.ResponseDeliverTx {
+	for _, key := range keys {
+		prefix, owners := governingOwners(tree.ImmutableTree, key)
+		if owners != nil && !isOwner(owners, signer) {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrUnauthorized,
+				Log:  fmt.Sprintf("Key %X is owned by prefix %X", key, prefix),
+			}
+		}
+	}
+	return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+}
+
+// controlsPrefix returns true if signer is an owner of prefix or of one of
+// its prefixes.
+func controlsPrefix(tree *iavl.ImmutableTree, signer ed25519.PubKey, prefix []byte) bool {
+	for i := len(prefix); i > 0; i-- {
+		if isOwner(getOwners(tree, prefix[:i]), signer) {
+			return true
+		}
+	}
+	return false
+}
+
+// grantAccess makes pubKey an owner of prefix. If prefix (or a prefix of it)
+// has owners already, signer must be one of them. Otherwise, prefix is
+// claimed, which is only allowed if there are no keys under it yet, so nobody
+// can lock others out of keys they wrote.
+func grantAccess(tree *iavl.MutableTree, signer ed25519.PubKey, prefix, pubKey []byte) abci.ResponseDeliverTx {
+	if signer == nil {
+		return abci.ResponseDeliverTx{Code: CodeTypeErrUnauthorized, Log: "ACL changes must be signed"}
+	}
+	if res := authorize(tree, signer, prefix); res.Code != abci.CodeTypeOK {
+		return res
+	}
+	if _, owners := governingOwners(tree.ImmutableTree, prefix); owners == nil {
+		var exists bool
+		prefixRange(prefix).iterate(tree.ImmutableTree, false, func(_, _ []byte) bool {
+			exists = true
+			return true
+		})
+		if exists {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrUnauthorized,
+				Log:  fmt.Sprintf("Can't claim prefix %X, which covers existing keys", prefix),
+			}
+		}
+	}
+
+	_, set := tree.Get(aclKey(prefix))
+	newSet, _, err := addToSet(set, pubKey)
+	if err != nil {
+		panic(fmt.Sprintf("corrupted ACL of %X: %v", prefix, err))
+	}
+	_ = tree.Set(aclKey(prefix), newSet)
+	return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+}
+
+// revokeAccess removes pubKey from the owners of prefix. Signer must be an
+// owner of prefix or of one of its prefixes, so owners of a prefix can revoke
+// grants of sub-prefixes. Once the last owner is removed, the prefix is
+// governed by its parent prefixes again.
+func revokeAccess(tree *iavl.MutableTree, signer ed25519.PubKey, prefix, pubKey []byte) abci.ResponseDeliverTx {
+	owners := getOwners(tree.ImmutableTree, prefix)
+	if owners == nil {
+		return abci.ResponseDeliverTx{
+			Code: CodeTypeErrBaseUnknownAddress,
+			Log:  fmt.Sprintf("Prefix %X has no ACL", prefix),
+		}
+	}
+	if !controlsPrefix(tree.ImmutableTree, signer, prefix) {
+		return abci.ResponseDeliverTx{
+			Code: CodeTypeErrUnauthorized,
+			Log:  fmt.Sprintf("Signer is not an owner of prefix %X or its prefixes", prefix),
+		}
+	}
+
+	_, set := tree.Get(aclKey(prefix))
+	newSet, removed, err := removeFromSet(set, pubKey)
+	if err != nil {
+		panic(fmt.Sprintf("corrupted ACL of %X: %v", prefix, err))
+	}
+	if !removed {
+		return abci.ResponseDeliverTx{
+			Code: CodeTypeErrBaseUnknownAddress,
+			Log:  fmt.Sprintf("%X is not an owner of prefix %X", pubKey, prefix),
+		}
+	}
+	if len(newSet) == 0 {
+		_, _ = tree.Remove(aclKey(prefix))
+	} else {
+		_ = tree.Set(aclKey(prefix), newSet)
+	}
+	return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+}
@@ -2,15 +2,21 @@ package merkleeyes
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"path/filepath"
+	"time"
 
+	"github.com/cosmos/iavl"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	abci "github.com/tendermint/tendermint/abci/types"
 	"github.com/tendermint/tendermint/crypto/ed25519"
 	cryptoenc "github.com/tendermint/tendermint/crypto/encoding"
 	"github.com/tendermint/tendermint/libs/log"
+	tmcrypto "github.com/tendermint/tendermint/proto/tendermint/crypto"
 	"github.com/tendermint/tendermint/version"
 	dbm "github.com/tendermint/tm-db"
 )
@@ -27,6 +33,35 @@ const (
 	TxTypeValSetChange  byte = 0x05
 	TxTypeValSetRead    byte = 0x06
 	TxTypeValSetCAS     byte = 0x07
+	TxTypeTxn           byte = 0x08
+	TxTypeAppend        byte = 0x09
+	TxTypeListRead      byte = 0x0A
+	TxTypeIncrement     byte = 0x0B
+	TxTypeDecrement     byte = 0x0C
+	TxTypeFetchAndAdd   byte = 0x0D
+	TxTypeInsert        byte = 0x0E
+	TxTypeCompareAndRm  byte = 0x0F
+	TxTypeGetAndSet     byte = 0x10
+	TxTypeCondTxn       byte = 0x11
+	TxTypeTransfer      byte = 0x12
+	TxTypeReadBalances  byte = 0x13
+	TxTypeSetAdd        byte = 0x14
+	TxTypeSetRead       byte = 0x15
+
+	TxTypeSetExpiring           byte = 0x16
+	TxTypeCompareAndSetExpiring byte = 0x17
+	TxTypeRmRange               byte = 0x18
+	TxTypeRmPrefix              byte = 0x19
+	TxTypeSetIfVersion          byte = 0x1A
+	TxTypeEnqueue               byte = 0x1B
+	TxTypeDequeue               byte = 0x1C
+	TxTypeDrain                 byte = 0x1D
+	TxTypeLockAcquire           byte = 0x1E
+	TxTypeLockRenew             byte = 0x1F
+	TxTypeLockRelease           byte = 0x20
+	TxTypeSigned                byte = 0x21
+	TxTypeAclGrant              byte = 0x22
+	TxTypeAclRevoke             byte = 0x23
 
 	NonceLength = 12
 
@@ -38,6 +73,14 @@ const (
 	CodeTypeInternalError         = 6
 	CodeTypeErrBaseUnknownAddress = 7
 	CodeTypeErrUnauthorized       = 8
+	CodeTypeErrUnknownHeight      = 9
+	CodeTypeErrOverflow           = 10
+	CodeTypeErrInsufficientFunds  = 11
+	CodeTypeErrQueueEmpty         = 12
+	CodeTypeErrLockHeld           = 13
+	CodeTypeErrBadSignature       = 14
+	CodeTypeErrWrongType          = 15
+	CodeTypeErrExpiryPassed       = 16
 )
 
 // App is a Merkle KV-store served as an ABCI app.
@@ -48,15 +91,31 @@ type App struct {
 	state   *State
 	changes []abci.ValidatorUpdate
 	logger  log.Logger
+
+	// time of the current block
+	blockTime time.Time
+
+	// number of blocks for which nonces are retained (0 = forever)
+	nonceWindow int64
+	chainID     string
+
+	// snapshots are taken every snapshotInterval blocks (0 = never), and the
+	// snapshotKeepRecent latest ones are kept (0 = all)
+	snapshots          *snapshotStore
+	snapshotInterval   int64
+	snapshotKeepRecent int
+	// snapshot being restored, if any
+	restore *snapshotRestore
 }
 
 var _ abci.Application = (*App)(nil)
 
+// dbName is the name of the database in the database directory.
+const dbName = "merkleeyes"
+
 // New initializes the database, loads any existing state, and returns a new
 // App.
-func New(dbDir string, treeCacheSize int) (*App, error) {
-	const dbName = "merkleeyes"
-
+func New(dbDir string, treeCacheSize int, opts ...Option) (*App, error) {
 	// Initialize a db.
 	db, err := dbm.NewGoLevelDB(dbName, dbDir)
 	if err != nil {
@@ -69,6 +128,48 @@ func New(dbDir string, treeCacheSize int) (*App, error) {
 		return nil, fmt.Errorf("create state: %w", err)
 	}
 
+	app := &App{
+		state:   state,
+		db:      db,
+		changes: make([]abci.ValidatorUpdate, 0),
+		logger:  log.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		opt(app)
+	}
+	if app.chainID != "" {
+		if err := app.state.SetChainID(db, app.chainID); err != nil {
+			return nil, fmt.Errorf("set chain ID: %w", err)
+		}
+	}
+	if app.snapshotInterval > 0 {
+		app.snapshots, err = newSnapshotStore(filepath.Join(dbDir, "snapshots"), app.snapshotKeepRecent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := app.resetCheckState(); err != nil {
+		return nil, fmt.Errorf("reset check state: %w", err)
+	}
+	return app, nil
+}
+
+// OpenReadOnly opens an existing database read-only and loads its state
+// without writing to the database, e.g. to export the state of a failed run
+// without changing it. The returned App is only meant for reading the state
+// (Export, Query, Info); it can't execute transactions.
+func OpenReadOnly(dbDir string, treeCacheSize int) (*App, error) {
+	db, err := dbm.NewGoLevelDBWithOpts(dbName, dbDir, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+
+	state, err := loadState(db, treeCacheSize, true)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("load state: %w", err)
+	}
+
 	return &App{
 		state:   state,
 		db:      db,
@@ -104,8 +205,9 @@ func (app *App) Info(req abci.RequestInfo) abci.ResponseInfo {
 
 // InitChain implements ABCI.
 func (app *App) InitChain(req abci.RequestInitChain) abci.ResponseInitChain {
+	app.state.ChainID = req.ChainId
 	for _, v := range req.Validators {
-		app.state.Validators.Set(&Validator{PubKey: ed25519.PubKey(v.PubKey.GetEd25519()), Power: v.Power})
+		app.state.SetValidator(&Validator{PubKey: ed25519.PubKey(v.PubKey.GetEd25519()), Power: v.Power})
 	}
 
 	return abci.ResponseInitChain{
@@ -113,15 +215,29 @@ func (app *App) InitChain(req abci.RequestInitChain) abci.ResponseInitChain {
 	}
 }
 
-// CheckTx implements ABCI.
+// CheckTx implements ABCI. The tx is executed against the check state, which
+// is reset to the committed state after every Commit, and is rejected if it
+// can't be decoded or its nonce, signature or sequence number is invalid. Txs
+// which would fail otherwise (e.g. a CAS with an outdated value) are accepted,
+// since they may succeed once earlier txs are executed.
+//
+// A tx whose nonce was used already, whether by a committed or a pending tx,
+// is rejected, so it's never admitted to the mempool again. For a committed
+// tx, the response carries the receipt's data and its code in the log. Rechecks
+// (after Commit) go through the same path.
 func (app *App) CheckTx(req abci.RequestCheckTx) abci.ResponseCheckTx {
-	if len(req.Tx) < minTxLen() {
+	res, replayed := app.runTx(app.state.Check, req.Tx, true)
+	if replayed {
 		return abci.ResponseCheckTx{
-			Code: CodeTypeEncodingError,
-			Log:  fmt.Sprintf("Tx length must be at least %d", minTxLen()),
+			Code: CodeTypeBadNonce,
+			Data: res.Data,
+			Log:  fmt.Sprintf("%s with code %d", res.Log, res.Code),
 		}
 	}
-
+	switch res.Code {
+	case CodeTypeEncodingError, CodeTypeErrUnknownRequest, CodeTypeBadNonce, CodeTypeErrBadSignature:
+		return abci.ResponseCheckTx{Code: res.Code, Log: res.Log}
+	}
 	return abci.ResponseCheckTx{Code: abci.CodeTypeOK}
 }
 
@@ -134,13 +250,26 @@ func (app *App) DeliverTx(req abci.RequestDeliverTx) abci.ResponseDeliverTx {
 func (app *App) BeginBlock(req abci.RequestBeginBlock) abci.ResponseBeginBlock {
 	// reset valset changes
 	app.changes = make([]abci.ValidatorUpdate, 0)
+
+	app.blockTime = req.Header.Time
+
+	// remove expired keys
+	for _, key := range expireKeys(app.state.Working, app.state.Height+1, app.blockTime) {
+		app.logger.Info("EXPIRE", "key", fmt.Sprintf("%X", key))
+	}
+
+	// prune nonces which fell out of the window
+	if n := pruneNonces(app.state.Working, app.state.Height+1); n > 0 {
+		app.logger.Info("PRUNE NONCES", "count", n)
+	}
+
 	return abci.ResponseBeginBlock{}
 }
 
 // EndBlock implements ABCI.
 func (app *App) EndBlock(req abci.RequestEndBlock) abci.ResponseEndBlock {
 	if len(app.changes) > 0 {
-		app.state.Validators.Version++
+		app.state.IncValidatorsVersion()
 	}
 	return abci.ResponseEndBlock{ValidatorUpdates: app.changes}
 }
@@ -151,39 +280,254 @@ func (app *App) Commit() abci.ResponseCommit {
 	if err != nil {
 		panic(err)
 	}
+	if err := app.resetCheckState(); err != nil {
+		panic(err)
+	}
+
+	// Snapshots are taken synchronously, so the snapshot height can't be
+	// pruned in the meantime. A failure doesn't affect the state.
+	if app.snapshots != nil && app.state.Height%app.snapshotInterval == 0 {
+		snapshot, err := app.createSnapshot()
+		if err != nil {
+			app.logger.Error("Can't create snapshot", "height", app.state.Height, "err", err)
+		} else {
+			app.logger.Info("SNAPSHOT", "height", snapshot.Height, "chunks", snapshot.Chunks)
+		}
+	}
+
 	return abci.ResponseCommit{Data: app.state.Hash()}
 }
 
+// ListSnapshots implements ABCI.
+func (app *App) ListSnapshots(req abci.RequestListSnapshots) abci.ResponseListSnapshots {
+	if app.snapshots == nil {
+		return abci.ResponseListSnapshots{}
+	}
+	snapshots, err := app.snapshots.list()
+	if err != nil {
+		app.logger.Error("Can't list snapshots", "err", err)
+		return abci.ResponseListSnapshots{}
+	}
+	return abci.ResponseListSnapshots{Snapshots: snapshots}
+}
+
+// LoadSnapshotChunk implements ABCI.
+func (app *App) LoadSnapshotChunk(req abci.RequestLoadSnapshotChunk) abci.ResponseLoadSnapshotChunk {
+	if app.snapshots == nil || req.Format != snapshotFormat {
+		return abci.ResponseLoadSnapshotChunk{}
+	}
+	chunk, err := app.snapshots.loadChunk(req.Height, req.Chunk)
+	if err != nil {
+		app.logger.Error("Can't load snapshot chunk", "height", req.Height, "chunk", req.Chunk, "err", err)
+		return abci.ResponseLoadSnapshotChunk{}
+	}
+	return abci.ResponseLoadSnapshotChunk{Chunk: chunk}
+}
+
+// OfferSnapshot implements ABCI. Snapshots are only accepted by an empty
+// node.
+func (app *App) OfferSnapshot(req abci.RequestOfferSnapshot) abci.ResponseOfferSnapshot {
+	app.restore = nil
+
+	switch {
+	case req.Snapshot == nil:
+		return abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}
+	case req.Snapshot.Format != snapshotFormat:
+		return abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT_FORMAT}
+	case req.Snapshot.Chunks == 0 || len(req.Snapshot.Metadata) != int(req.Snapshot.Chunks)*sha256.Size:
+		return abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_REJECT}
+	case app.state.Height != 0:
+		app.logger.Error("Can't restore a snapshot into a non-empty state", "height", app.state.Height)
+		return abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ABORT}
+	}
+
+	app.restore = &snapshotRestore{snapshot: req.Snapshot, appHash: req.AppHash}
+	return abci.ResponseOfferSnapshot{Result: abci.ResponseOfferSnapshot_ACCEPT}
+}
+
+// ApplySnapshotChunk implements ABCI.
+func (app *App) ApplySnapshotChunk(req abci.RequestApplySnapshotChunk) abci.ResponseApplySnapshotChunk {
+	r := app.restore
+	if r == nil {
+		return abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ABORT}
+	}
+
+	if req.Index != r.next {
+		return abci.ResponseApplySnapshotChunk{
+			Result:        abci.ResponseApplySnapshotChunk_RETRY,
+			RefetchChunks: []uint32{r.next},
+		}
+	}
+	if !r.verifyChunk(req.Index, req.Chunk) {
+		app.logger.Error("Invalid snapshot chunk", "index", req.Index, "sender", req.Sender)
+		return abci.ResponseApplySnapshotChunk{
+			Result:        abci.ResponseApplySnapshotChunk_RETRY,
+			RefetchChunks: []uint32{req.Index},
+			RejectSenders: []string{req.Sender},
+		}
+	}
+	r.payload.Write(req.Chunk)
+	r.next++
+	if r.next < r.snapshot.Chunks {
+		return abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}
+	}
+
+	app.restore = nil
+	if err := app.restoreSnapshot(r); err != nil {
+		app.logger.Error("Can't restore snapshot", "height", r.snapshot.Height, "err", err)
+		return abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_REJECT_SNAPSHOT}
+	}
+	app.logger.Info("RESTORED SNAPSHOT", "height", app.state.Height, "hash", fmt.Sprintf("%X", app.state.Hash()))
+	return abci.ResponseApplySnapshotChunk{Result: abci.ResponseApplySnapshotChunk_ACCEPT}
+}
+
+// createSnapshot takes a snapshot of the committed state.
+func (app *App) createSnapshot() (*abci.Snapshot, error) {
+	aux := auxState{Height: app.state.Height, ChainID: app.state.ChainID}
+	return app.snapshots.create(uint64(app.state.Height), func(w *chunkWriter) error {
+		return writePayload(w, aux, app.state.Committed)
+	})
+}
+
+// restoreSnapshot replaces the (empty) state with the snapshot's. If that
+// fails, the state is empty again.
+func (app *App) restoreSnapshot(r *snapshotRestore) error {
+	return app.restoreState(func(tree *iavl.MutableTree) error {
+		if sum := sha256.Sum256(r.payload.Bytes()); !bytes.Equal(sum[:], r.snapshot.Hash) {
+			return fmt.Errorf("payload hash %X doesn't match snapshot hash %X", sum, r.snapshot.Hash)
+		}
+
+		aux, err := importPayload(&r.payload, tree)
+		if err != nil {
+			return err
+		}
+		if uint64(aux.Height) != r.snapshot.Height {
+			return fmt.Errorf("restored height %d, expected %d", aux.Height, r.snapshot.Height)
+		}
+		if !bytes.Equal(tree.Hash(), r.appHash) {
+			return fmt.Errorf("restored app hash %X, expected %X", tree.Hash(), r.appHash)
+		}
+		return saveAuxState(app.db, tree.Version(), aux)
+	})
+}
+
+// restoreState replaces the state using fill (see replaceState). If that
+// fails, the state is reset to an empty one.
+func (app *App) restoreState(fill func(tree *iavl.MutableTree) error) error {
+	err := app.replaceState(fill)
+	if err != nil {
+		if resetErr := app.replaceState(func(*iavl.MutableTree) error { return nil }); resetErr != nil {
+			panic(resetErr)
+		}
+	}
+	return err
+}
+
+// replaceState wipes the database, lets fill write a new tree and auxiliary
+// state into it, and loads the new state. If fill fails, the state isn't
+// reloaded.
+func (app *App) replaceState(fill func(tree *iavl.MutableTree) error) error {
+	if err := wipeDB(app.db); err != nil {
+		return err
+	}
+
+	tree, err := iavl.NewMutableTree(app.db, app.state.treeCacheSize)
+	if err != nil {
+		return fmt.Errorf("create tree: %w", err)
+	}
+	if err := fill(tree); err != nil {
+		return err
+	}
+
+	state, err := NewState(app.db, app.state.treeCacheSize)
+	if err != nil {
+		return fmt.Errorf("load state: %w", err)
+	}
+	state.Pruning = app.state.Pruning
+	app.state = state
+	return app.resetCheckState()
+}
+
+// resetCheckState resets the check state to the committed state and prepares
+// it for the next block like BeginBlock does, except for time-based expiries
+// (the time of the next block isn't known yet).
+func (app *App) resetCheckState() error {
+	if err := app.state.ResetCheck(app.db); err != nil {
+		return err
+	}
+	_ = expireKeys(app.state.Check, app.state.Height+1, time.Time{})
+	_ = pruneNonces(app.state.Check, app.state.Height+1)
+	return nil
+}
+
 // Query implements ABCI.
 func (app *App) Query(req abci.RequestQuery) (res abci.ResponseQuery) {
-	tree := app.state.Committed
-
-	if req.Height != 0 {
-		res.Code = CodeTypeInternalError
-		res.Log = "merkleeyes only supports queries on latest commit"
+	tree, err := app.state.CommittedAt(req.Height)
+	if err != nil {
+		res.Code = CodeTypeErrUnknownHeight
+		res.Log = fmt.Sprintf("Can't query height %d: %v", req.Height, err)
 		return
 	}
 
-	res.Height = app.state.Height
+	res.Height = req.Height
+	if res.Height == 0 {
+		res.Height = app.state.Height
+	}
 
 	switch req.Path {
 
 	case "/store", "/key": // Get by key
 		key := req.Data // Data holds the key bytes
 		res.Key = key
+		index, value := tree.Get(storeKey(key))
 		if req.Prove {
+			proofOp, err := proveKey(tree, storeKey(key))
+			if err != nil {
+				res.Code = CodeTypeInternalError
+				res.Log = fmt.Sprintf("Can't prove key %X: %v", key, err)
+				return
+			}
+			res.ProofOps = &tmcrypto.ProofOps{Ops: []tmcrypto.ProofOp{proofOp}}
+		}
+		if value == nil {
+			res.Code = CodeTypeErrBaseUnknownAddress
+			res.Log = "not found"
+			return
+		}
+		res.Value = value
+		res.Index = int64(index)
+		bz, err := json.Marshal(getMeta(tree, key))
+		if err != nil {
 			res.Code = CodeTypeInternalError
-			res.Log = "Query with proof is not supported"
-		} else {
-			index, value := tree.Get(storeKey(key))
-			if value == nil {
-				res.Code = CodeTypeErrBaseUnknownAddress
-				res.Log = "not found"
+			res.Log = fmt.Sprintf("Marshaling error: %v", err)
+			return
+		}
+		res.Info = string(bz)
+
+	case "/receipt": // Get receipt by nonce
+		nonce := req.Data
+		res.Key = nonce
+		_, value := tree.Get(nonceKey(nonce))
+		if req.Prove {
+			proofOp, err := proveKey(tree, nonceKey(nonce))
+			if err != nil {
+				res.Code = CodeTypeInternalError
+				res.Log = fmt.Sprintf("Can't prove nonce %X: %v", nonce, err)
 				return
 			}
-			res.Value = value
-			res.Index = int64(index)
+			res.ProofOps = &tmcrypto.ProofOps{Ops: []tmcrypto.ProofOp{proofOp}}
+		}
+		if value == nil {
+			res.Code = CodeTypeErrBaseUnknownAddress
+			res.Log = "not found"
+			return
+		}
+		if _, err := decodeReceipt(value); err != nil {
+			res.Code = CodeTypeInternalError
+			res.Log = fmt.Sprintf("Can't decode receipt for nonce %X: %v", nonce, err)
+			return
 		}
+		res.Value = value
 
 	case "/index": // Get by Index
 		index, n := binary.Varint(req.Data)
@@ -203,6 +547,74 @@ func (app *App) Query(req abci.RequestQuery) (res abci.ResponseQuery) {
 		res.Index = int64(index)
 		res.Value = value
 
+	case "/range", "/prefix": // Scan keys
+		decode := decodeRangeQuery
+		if req.Path == "/prefix" {
+			decode = decodePrefixQuery
+		}
+		q, err := decode(req.Data)
+		if err != nil {
+			res.Code = CodeTypeEncodingError
+			res.Log = fmt.Sprintf("Can't decode %s query: %v", req.Path, err)
+			return
+		}
+
+		res.Value, res.Key = q.run(tree)
+
+	case "/account": // Get the next sequence number of an account
+		res.Key = req.Data
+		res.Value = encodeInt64(getSequence(tree, req.Data))
+
+	case "/acl": // Get the owners of a key prefix
+		res.Key = req.Data
+		_, res.Value = tree.Get(aclKey(req.Data))
+		if res.Value == nil {
+			res.Code = CodeTypeErrBaseUnknownAddress
+			res.Log = "not found"
+			return
+		}
+
+	case "/validator": // Get a validator's power by pubkey
+		pubKey := req.Data
+		res.Key = pubKey
+		_, value := tree.Get(validatorKey(pubKey))
+		if req.Prove {
+			proofOp, err := proveKey(tree, validatorKey(pubKey))
+			if err != nil {
+				res.Code = CodeTypeInternalError
+				res.Log = fmt.Sprintf("Can't prove validator %X: %v", pubKey, err)
+				return
+			}
+			res.ProofOps = &tmcrypto.ProofOps{Ops: []tmcrypto.ProofOp{proofOp}}
+		}
+		if value == nil {
+			res.Code = CodeTypeErrBaseUnknownAddress
+			res.Log = "not found"
+			return
+		}
+		res.Value = value
+
+	case "/validators": // Get the validator set
+		// a set of existence proofs wouldn't prove the set is complete
+		if req.Prove {
+			res.Code = CodeTypeUnknownRequest
+			res.Log = "The validator set can't be proven, query /validator for each pubkey"
+			return
+		}
+		vss, found := loadValidatorSet(tree)
+		if !found {
+			res.Code = CodeTypeErrBaseUnknownAddress
+			res.Log = "not found"
+			return
+		}
+		bz, err := json.Marshal(vss)
+		if err != nil {
+			res.Code = CodeTypeInternalError
+			res.Log = fmt.Sprintf("Marshaling error: %v", err)
+			return
+		}
+		res.Value = bz
+
 	case "/size": // Get size
 		buf := make([]byte, binary.MaxVarintLen64)
 		n := binary.PutVarint(buf, tree.Size())
@@ -216,6 +628,23 @@ func (app *App) Query(req abci.RequestQuery) (res abci.ResponseQuery) {
 	return
 }
 
+// proveKey returns an existence or absence proof for the given (store) key,
+// verifiable against the tree's root hash.
+func proveKey(tree *iavl.ImmutableTree, key []byte) (tmcrypto.ProofOp, error) {
+	value, proof, err := tree.GetWithProof(key)
+	if err != nil {
+		return tmcrypto.ProofOp{}, err
+	}
+	if proof == nil {
+		return tmcrypto.ProofOp{}, errors.New("tree is empty")
+	}
+
+	if value != nil {
+		return iavl.NewValueOp(key, proof).ProofOp(), nil
+	}
+	return iavl.NewAbsenceOp(key, proof).ProofOp(), nil
+}
+
 func nonceKey(nonce []byte) []byte {
 	return append([]byte("/nonce/"), nonce...)
 }
@@ -224,50 +653,191 @@ func storeKey(key []byte) []byte {
 	return append([]byte("/key/"), key...)
 }
 
+// setKey sets key to value, clearing any expiry of the key and updating its
+// metadata.
+func setKey(tree *iavl.MutableTree, key, value []byte) {
+	clearExpiry(tree, key)
+	touchMeta(tree, key)
+	_ = tree.Set(storeKey(key), value)
+}
+
+// removeKey removes key along with its expiry and metadata. It returns false
+// if the key didn't exist.
+func removeKey(tree *iavl.MutableTree, key []byte) bool {
+	clearExpiry(tree, key)
+	_, _ = tree.Remove(metaKey(key))
+	_, removed := tree.Remove(storeKey(key))
+	return removed
+}
+
 func (app *App) doTx(tx []byte) abci.ResponseDeliverTx {
+	res, _ := app.runTx(app.state.Working, tx, false)
+	return res
+}
+
+// runTx checks the nonce (and signature, if any) of tx and executes it against
+// tree. If the nonce was used already, the stored receipt is returned instead
+// and replayed is true. If check is true, tx is executed by CheckTx against
+// the check state: nothing is logged, validator set changes are not applied
+// and a nonce which was only used in the check state (i.e. by a tx which is
+// still pending) is an error.
+func (app *App) runTx(tree *iavl.MutableTree, tx []byte, check bool) (res abci.ResponseDeliverTx, replayed bool) {
 	if len(tx) < minTxLen() {
 		return abci.ResponseDeliverTx{
 			Code: CodeTypeEncodingError,
 			Log:  fmt.Sprintf("Tx length must be at least %d", minTxLen()),
-		}
+		}, false
+	}
+
+	ctx := execContext{tree: tree, logger: app.logger, check: check}
+	if check {
+		ctx.logger = log.NewNopLogger()
 	}
 
-	var (
-		tree  = app.state.Working
-		nonce = tx[:NonceLength]
-	)
+	nonce := tx[:NonceLength]
 	tx = tx[NonceLength:]
 
 	// 1) Check nonce
-	_, n := tree.Get(nonceKey(nonce))
-	if n != nil {
+	height := app.state.Height + 1
+	if app.nonceWindow > 0 {
+		if err := checkNonceHeight(nonce, height, app.nonceWindow); err != nil {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeBadNonce,
+				Log:  fmt.Sprintf("Nonce %X is invalid at height %d: %v", nonce, height, err),
+			}, false
+		}
+	}
+	receipt, err := getReceipt(tree.ImmutableTree, nonce)
+	if err != nil {
+		return abci.ResponseDeliverTx{
+			Code: CodeTypeBadNonce,
+			Log:  fmt.Sprintf("Nonce %X already exists: %v", nonce, err),
+		}, false
+	}
+	if receipt != nil {
+		if check && receipt.Height > app.state.Height {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeBadNonce,
+				Log:  fmt.Sprintf("Nonce %X is used by a pending tx", nonce),
+			}, false
+		}
+		ctx.logger.Info("REPLAY", "nonce", fmt.Sprintf("%X", nonce), "height", receipt.Height)
 		return abci.ResponseDeliverTx{
+			Code:   receipt.Code,
+			Data:   receipt.Data,
+			Events: receipt.Events,
+			Log:    fmt.Sprintf("Nonce %X already processed at height %d", nonce, receipt.Height),
+		}, true
+	}
+
+	// 2) Unwrap a signed tx
+	typeByte, args := tx[0], tx[1:]
+	var st *signedTx
+	if typeByte == TxTypeSigned {
+		var errResp abci.ResponseDeliverTx
+		if st, errResp = app.openSignedTx(tree, nonce, args); st == nil {
+			return errResp, false
+		}
+		typeByte, args = st.payload[0], st.payload[1:]
+		ctx.signer = st.pubKey
+	}
+
+	// 3) Execute tx based on type
+	res = app.execTx(ctx, typeByte, args)
+
+	// 4) Store the receipt, which also marks the nonce as processed. A tx which
+	// couldn't be decoded didn't execute, so its nonce can be used again.
+	if res.Code == CodeTypeEncodingError || res.Code == CodeTypeErrUnknownRequest {
+		return res, false
+	}
+	if st != nil {
+		setSequence(tree, st.pubKey, st.sequence+1)
+		res.Events = append(res.Events, st.event())
+		ctx.logger.Info("SIGNED", "sender", fmt.Sprintf("%X", st.pubKey.Bytes()), "sequence", st.sequence)
+	}
+	setReceipt(tree, nonce, &Receipt{
+		Code:   res.Code,
+		Data:   res.Data,
+		Events: res.Events,
+		Height: height,
+	})
+	if app.nonceWindow > 0 {
+		setNonceExpiry(tree, nonce, nonceHeight(nonce)+app.nonceWindow+1)
+	}
+
+	return res, false
+}
+
+// openSignedTx decodes a signed tx and checks its signature and sequence number.
+func (app *App) openSignedTx(tree *iavl.MutableTree, nonce, tx []byte) (*signedTx, abci.ResponseDeliverTx) {
+	st, errResp := decodeSignedTx(tx)
+	if st == nil {
+		return nil, errResp
+	}
+	if res := st.verify(app.state.ChainID, nonce); res.Code != abci.CodeTypeOK {
+		return nil, res
+	}
+	if seq := getSequence(tree.ImmutableTree, st.pubKey); st.sequence != seq {
+		return nil, abci.ResponseDeliverTx{
 			Code: CodeTypeBadNonce,
-			Log:  fmt.Sprintf("Nonce %X already exists", nonce),
+			Log:  fmt.Sprintf("Expected sequence %d of %X, got %d", seq, st.pubKey.Bytes(), st.sequence),
 		}
 	}
-	// mark nonce as processed
-	_ = tree.Set(nonceKey(nonce), []byte{0x01})
+	return st, abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+}
+
+// execContext is the context a tx is executed in.
+type execContext struct {
+	tree   *iavl.MutableTree
+	signer ed25519.PubKey // nil if the tx isn't signed
+	logger log.Logger
+
+	// check is true if the tx is executed by CheckTx against the check state.
+	// Validator set changes are not applied then.
+	check bool
+}
 
-	typeByte := tx[0]
-	tx = tx[1:]
+func (app *App) execTx(ctx execContext, typeByte byte, tx []byte) abci.ResponseDeliverTx {
+	tree, signer := ctx.tree, ctx.signer
 
-	// 2) Execute tx based on type
 	switch typeByte {
-	case TxTypeSet:
+	case TxTypeSigned:
+		// the signer of the outer tx can't act as another one
+		return abci.ResponseDeliverTx{Code: CodeTypeErrUnauthorized, Log: "Signed txs can't be nested"}
+
+	case TxTypeSet, TxTypeSetExpiring:
 		key, errResp, n := unmarshalBytes(tx, "key", false)
 		if key == nil {
 			return errResp
 		}
 
-		value, errResp, _ := unmarshalBytes(tx[n:], "value", true)
+		value, errResp, n2 := unmarshalBytes(tx[n:], "value", typeByte == TxTypeSet)
 		if value == nil {
 			return errResp
 		}
 
-		_ = tree.Set(storeKey(key), value)
+		if typeByte == TxTypeSetExpiring {
+			e, errResp := app.decodeTxExpiry(tx[n+n2:])
+			if errResp.Code != abci.CodeTypeOK {
+				return errResp
+			}
+			if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+				return res
+			}
+
+			setKey(tree, key, value)
+			setExpiry(tree, key, e)
+
+			ctx.logger.Info("SET", "key", fmt.Sprintf("%X", key), "value", fmt.Sprintf("%X", value), "expiry", e)
+			return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+		}
+
+		if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		setKey(tree, key, value)
 
-		app.logger.Info("SET", "key", fmt.Sprintf("%X", key), "value", fmt.Sprintf("%X", value))
+		ctx.logger.Info("SET", "key", fmt.Sprintf("%X", key), "value", fmt.Sprintf("%X", value))
 		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
 
 	case TxTypeRm:
@@ -276,16 +846,19 @@ func (app *App) doTx(tx []byte) abci.ResponseDeliverTx {
 			return errResp
 		}
 
-		_, removed := tree.Remove(storeKey(key))
+		if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		removed := removeKey(tree, key)
 		if !removed {
-			app.logger.Info("RM -> FAILED", "key", fmt.Sprintf("%X", key))
+			ctx.logger.Info("RM -> FAILED", "key", fmt.Sprintf("%X", key))
 			return abci.ResponseDeliverTx{
 				Code: CodeTypeErrBaseUnknownAddress,
 				Log:  fmt.Sprintf("Failed to remove %X", key),
 			}
 		}
 
-		app.logger.Info("RM", "key", fmt.Sprintf("%X", key))
+		ctx.logger.Info("RM", "key", fmt.Sprintf("%X", key))
 		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
 
 	case TxTypeGet:
@@ -296,16 +869,18 @@ func (app *App) doTx(tx []byte) abci.ResponseDeliverTx {
 
 		_, value := tree.Get(storeKey(key))
 		if value == nil {
-			app.logger.Info("GET -> NOT FOUND", "key", fmt.Sprintf("%X", key))
+			ctx.logger.Info("GET -> NOT FOUND", "key", fmt.Sprintf("%X", key))
 			return abci.ResponseDeliverTx{
 				Code: CodeTypeErrBaseUnknownAddress,
 				Log:  fmt.Sprintf("Cannot find key: %X", key)}
 		}
 
-		app.logger.Info("GET", "key", fmt.Sprintf("%X", key), "value", fmt.Sprintf("%X", value))
-		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: value}
+		meta := getMeta(tree.ImmutableTree, key)
+
+		ctx.logger.Info("GET", "key", fmt.Sprintf("%X", key), "value", fmt.Sprintf("%X", value), "version", meta.Version)
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: value, Events: []abci.Event{meta.event()}}
 
-	case TxTypeCompareAndSet:
+	case TxTypeCompareAndSet, TxTypeCompareAndSetExpiring:
 		key, errResp, n := unmarshalBytes(tx, "key", false)
 		if key == nil {
 			return errResp
@@ -316,14 +891,26 @@ func (app *App) doTx(tx []byte) abci.ResponseDeliverTx {
 			return errResp
 		}
 
-		setValue, errResp, _ := unmarshalBytes(tx[n+n2:], "setValue", true)
+		setValue, errResp, n3 := unmarshalBytes(tx[n+n2:], "setValue", typeByte == TxTypeCompareAndSet)
 		if setValue == nil {
 			return errResp
 		}
 
+		var e *expiry
+		if typeByte == TxTypeCompareAndSetExpiring {
+			exp, errResp := app.decodeTxExpiry(tx[n+n2+n3:])
+			if errResp.Code != abci.CodeTypeOK {
+				return errResp
+			}
+			e = &exp
+		}
+
+		if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+			return res
+		}
 		_, value := tree.Get(storeKey(key))
 		if value == nil {
-			app.logger.Info("CAS -> NOT FOUND", "key", fmt.Sprintf("%X", key))
+			ctx.logger.Info("CAS -> NOT FOUND", "key", fmt.Sprintf("%X", key))
 			return abci.ResponseDeliverTx{
 				Code: CodeTypeErrBaseUnknownAddress,
 				Log:  fmt.Sprintf("Cannot find key: %X", key),
@@ -331,7 +918,7 @@ func (app *App) doTx(tx []byte) abci.ResponseDeliverTx {
 		}
 
 		if !bytes.Equal(value, compareValue) {
-			app.logger.Info("CAS-REJECTED",
+			ctx.logger.Info("CAS-REJECTED",
 				"key", fmt.Sprintf("%X", key),
 				"compare", fmt.Sprintf("%X", compareValue),
 				"actual-value", fmt.Sprintf("%X", value),
@@ -342,54 +929,545 @@ func (app *App) doTx(tx []byte) abci.ResponseDeliverTx {
 			}
 		}
 
-		_ = tree.Set(storeKey(key), setValue)
+		setKey(tree, key, setValue)
+		if e != nil {
+			setExpiry(tree, key, *e)
+		}
 
-		app.logger.Info("CAS-SET",
+		ctx.logger.Info("CAS-SET",
 			"key", fmt.Sprintf("%X", key),
 			"compare", fmt.Sprintf("%X", compareValue),
 			"set-value", fmt.Sprintf("%X", setValue),
+			"expiry", e,
 		)
 		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
 
-	case TxTypeValSetChange:
-		pubKey, errResp, n := unmarshalBytes(tx, "pubKey", false)
-		if pubKey == nil {
+	case TxTypeSetIfVersion:
+		key, errResp, n := unmarshalBytes(tx, "key", false)
+		if key == nil {
 			return errResp
 		}
+		tx = tx[n:]
 
-		if len(pubKey) != ed25519.PubKeySize {
+		if len(tx) < 8 {
 			return abci.ResponseDeliverTx{
 				Code: CodeTypeEncodingError,
-				Log:  fmt.Sprintf("PubKey must be %d bytes: %X is %d bytes", ed25519.PubKeySize, pubKey, len(pubKey)),
+				Log:  "Can't decode version: not enough bytes",
 			}
 		}
+		version := int64(binary.BigEndian.Uint64(tx[:8]))
+		tx = tx[8:]
+
+		value, errResp, _ := unmarshalBytes(tx, "value", true)
+		if value == nil {
+			return errResp
+		}
 
-		tx = tx[n:]
-		power, err := decodeInt(tx)
-		if err != nil {
+		if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		exists := tree.Has(storeKey(key))
+		if !exists && version != 0 {
+			ctx.logger.Info("SET-IF-VERSION -> NOT FOUND", "key", fmt.Sprintf("%X", key))
 			return abci.ResponseDeliverTx{
-				Code: CodeTypeEncodingError,
-				Log:  fmt.Sprintf("Can't decode power: %v", err),
+				Code: CodeTypeErrBaseUnknownAddress,
+				Log:  fmt.Sprintf("Cannot find key: %X", key),
 			}
 		}
 
-		app.logger.Info("VALSET-CHANGE",
-			"pubkey", fmt.Sprintf("%X", pubKey),
-			"power", power,
-		)
-
-		return app.updateValidator(pubKey, int64(power))
-
-	case TxTypeValSetRead:
-		bz, err := json.Marshal(app.state.Validators)
-		if err != nil {
-			return abci.ResponseDeliverTx{
-				Code: CodeTypeInternalError,
-				Log:  fmt.Sprintf("Marshaling error: %v", err),
+		if exists {
+			actual := getMeta(tree.ImmutableTree, key).Version
+			if version == 0 || actual != version {
+				ctx.logger.Info("SET-IF-VERSION-REJECTED",
+					"key", fmt.Sprintf("%X", key),
+					"version", version,
+					"actual-version", actual,
+				)
+				log := fmt.Sprintf("Version was %d, not %d", actual, version)
+				if version == 0 {
+					log = fmt.Sprintf("Key %X already exists", key)
+				}
+				return abci.ResponseDeliverTx{Code: CodeTypeErrUnauthorized, Log: log}
 			}
 		}
 
-		app.logger.Info("VALSET-READ", "version", app.state.Validators.Version)
+		setKey(tree, key, value)
+
+		ctx.logger.Info("SET-IF-VERSION", "key", fmt.Sprintf("%X", key), "version", version, "value", fmt.Sprintf("%X", value))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+
+	case TxTypeInsert:
+		key, errResp, n := unmarshalBytes(tx, "key", false)
+		if key == nil {
+			return errResp
+		}
+
+		value, errResp, _ := unmarshalBytes(tx[n:], "value", true)
+		if value == nil {
+			return errResp
+		}
+
+		if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		_, existing := tree.Get(storeKey(key))
+		if existing != nil {
+			ctx.logger.Info("INSERT-REJECTED", "key", fmt.Sprintf("%X", key), "actual-value", fmt.Sprintf("%X", existing))
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrUnauthorized,
+				Log:  fmt.Sprintf("Key %X already exists", key),
+			}
+		}
+
+		setKey(tree, key, value)
+
+		ctx.logger.Info("INSERT", "key", fmt.Sprintf("%X", key), "value", fmt.Sprintf("%X", value))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+
+	case TxTypeCompareAndRm:
+		key, errResp, n := unmarshalBytes(tx, "key", false)
+		if key == nil {
+			return errResp
+		}
+
+		compareValue, errResp, _ := unmarshalBytes(tx[n:], "compareValue", true)
+		if compareValue == nil {
+			return errResp
+		}
+
+		if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		_, value := tree.Get(storeKey(key))
+		if value == nil {
+			ctx.logger.Info("CAS-RM -> NOT FOUND", "key", fmt.Sprintf("%X", key))
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrBaseUnknownAddress,
+				Log:  fmt.Sprintf("Cannot find key: %X", key),
+			}
+		}
+
+		if !bytes.Equal(value, compareValue) {
+			ctx.logger.Info("CAS-RM-REJECTED",
+				"key", fmt.Sprintf("%X", key),
+				"compare", fmt.Sprintf("%X", compareValue),
+				"actual-value", fmt.Sprintf("%X", value),
+			)
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrUnauthorized,
+				Log:  fmt.Sprintf("Value was %X, not %X", value, compareValue),
+			}
+		}
+
+		_ = removeKey(tree, key)
+
+		ctx.logger.Info("CAS-RM", "key", fmt.Sprintf("%X", key), "compare", fmt.Sprintf("%X", compareValue))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+
+	case TxTypeGetAndSet:
+		key, errResp, n := unmarshalBytes(tx, "key", false)
+		if key == nil {
+			return errResp
+		}
+
+		value, errResp, _ := unmarshalBytes(tx[n:], "value", true)
+		if value == nil {
+			return errResp
+		}
+
+		if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		_, oldValue := tree.Get(storeKey(key))
+		setKey(tree, key, value)
+
+		ctx.logger.Info("GET-AND-SET",
+			"key", fmt.Sprintf("%X", key),
+			"old-value", fmt.Sprintf("%X", oldValue),
+			"value", fmt.Sprintf("%X", value),
+		)
+		// a missing key returns empty data (values are never empty)
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: oldValue}
+
+	case TxTypeCondTxn:
+		ct, errResp := decodeCondTxn(tx)
+		if ct == nil {
+			return errResp
+		}
+
+		if res := authorize(tree, signer, ct.writtenKeys()...); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		succeeded, reads, err := ct.apply(tree)
+		if err != nil {
+			ctx.logger.Info("COND-TXN -> NOT A LIST", "err", err)
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrWrongType,
+				Log:  fmt.Sprintf("Can't apply cond txn: %v", err),
+			}
+		}
+
+		ctx.logger.Info("COND-TXN",
+			"guards", fmt.Sprintf("%v", ct.guards),
+			"then", fmt.Sprintf("%v", ct.thenOps),
+			"else", fmt.Sprintf("%v", ct.elseOps),
+			"succeeded", succeeded,
+		)
+		branch := CondTxnElse
+		if succeeded {
+			branch = CondTxnThen
+		}
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: append([]byte{branch}, reads...)}
+
+	case TxTypeTransfer:
+		from, errResp, n := unmarshalBytes(tx, "from", false)
+		if from == nil {
+			return errResp
+		}
+		tx = tx[n:]
+
+		to, errResp, n := unmarshalBytes(tx, "to", false)
+		if to == nil {
+			return errResp
+		}
+		tx = tx[n:]
+
+		if len(tx) != 8 {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  fmt.Sprintf("Amount must be 8 bytes, got %d", len(tx)),
+			}
+		}
+		amount := int64(binary.BigEndian.Uint64(tx))
+		if amount < 0 {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  fmt.Sprintf("Negative amount %d", amount),
+			}
+		}
+
+		if res := authorize(tree, signer, from, to); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		res := transfer(tree, from, to, amount)
+		if res.Code != abci.CodeTypeOK {
+			ctx.logger.Info("TRANSFER -> FAILED",
+				"from", fmt.Sprintf("%X", from),
+				"to", fmt.Sprintf("%X", to),
+				"amount", amount,
+				"code", res.Code,
+			)
+			return res
+		}
+
+		ctx.logger.Info("TRANSFER", "from", fmt.Sprintf("%X", from), "to", fmt.Sprintf("%X", to), "amount", amount)
+		return res
+
+	case TxTypeReadBalances:
+		if len(tx) == 0 {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  "Must read at least one balance",
+			}
+		}
+
+		var balances []byte
+		for len(tx) > 0 {
+			key, errResp, n := unmarshalBytes(tx, "key", false)
+			if key == nil {
+				return errResp
+			}
+			tx = tx[n:]
+
+			balance, res := getCounter(tree, key)
+			if res.Code != abci.CodeTypeOK {
+				return res
+			}
+			balances = append(balances, encodeInt64(balance)...)
+		}
+
+		ctx.logger.Info("READ-BALANCES", "balances", fmt.Sprintf("%X", balances))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: balances}
+
+	case TxTypeSetAdd:
+		key, errResp, n := unmarshalBytes(tx, "key", false)
+		if key == nil {
+			return errResp
+		}
+
+		elem, errResp, _ := unmarshalBytes(tx[n:], "element", true)
+		if elem == nil {
+			return errResp
+		}
+
+		if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		_, set := tree.Get(storeKey(key))
+		newSet, added, err := addToSet(set, elem)
+		if err != nil {
+			ctx.logger.Info("SET-ADD -> NOT A SET", "key", fmt.Sprintf("%X", key))
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrWrongType,
+				Log:  fmt.Sprintf("Value of %X is not a set: %v", key, err),
+			}
+		}
+
+		if !added {
+			ctx.logger.Info("SET-ADD -> ALREADY PRESENT", "key", fmt.Sprintf("%X", key), "element", fmt.Sprintf("%X", elem))
+			return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: []byte{0x00}}
+		}
+
+		setKey(tree, key, newSet)
+
+		ctx.logger.Info("SET-ADD", "key", fmt.Sprintf("%X", key), "element", fmt.Sprintf("%X", elem))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: []byte{0x01}}
+
+	case TxTypeSetRead:
+		key, errResp, _ := unmarshalBytes(tx, "key", true)
+		if key == nil {
+			return errResp
+		}
+
+		_, set := tree.Get(storeKey(key))
+		if _, err := decodeSet(set); err != nil {
+			ctx.logger.Info("SET-READ -> NOT A SET", "key", fmt.Sprintf("%X", key))
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrWrongType,
+				Log:  fmt.Sprintf("Value of %X is not a set: %v", key, err),
+			}
+		}
+
+		ctx.logger.Info("SET-READ", "key", fmt.Sprintf("%X", key), "set", fmt.Sprintf("%X", set))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: set}
+
+	case TxTypeRmRange, TxTypeRmPrefix:
+		var r keyRange
+		if typeByte == TxTypeRmRange {
+			start, n, err := decodeBytes(tx)
+			if err != nil {
+				return abci.ResponseDeliverTx{
+					Code: CodeTypeEncodingError,
+					Log:  fmt.Sprintf("Can't decode start: %v", err),
+				}
+			}
+			end, n2, err := decodeBytes(tx[n:])
+			if err != nil {
+				return abci.ResponseDeliverTx{
+					Code: CodeTypeEncodingError,
+					Log:  fmt.Sprintf("Can't decode end: %v", err),
+				}
+			}
+			if len(tx) > n+n2 {
+				return abci.ResponseDeliverTx{Code: CodeTypeEncodingError, Log: "Got bytes left over"}
+			}
+			r.start = start
+			if len(end) > 0 {
+				r.end = end
+			}
+		} else {
+			prefix, errResp, _ := unmarshalBytes(tx, "prefix", true)
+			if prefix == nil {
+				return errResp
+			}
+			r = prefixRange(prefix)
+		}
+
+		if res := authorize(tree, signer, r.keys(tree.ImmutableTree)...); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		removed := removeRange(tree, r)
+
+		ctx.logger.Info("RM-RANGE",
+			"start", fmt.Sprintf("%X", r.start),
+			"end", fmt.Sprintf("%X", r.end),
+			"removed", removed,
+		)
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: encodeInt64(int64(removed))}
+
+	case TxTypeEnqueue:
+		name, errResp, n := unmarshalBytes(tx, "name", false)
+		if name == nil {
+			return errResp
+		}
+
+		elem, errResp, _ := unmarshalBytes(tx[n:], "element", true)
+		if elem == nil {
+			return errResp
+		}
+
+		enqueue(tree, name, elem)
+
+		ctx.logger.Info("ENQUEUE", "queue", fmt.Sprintf("%X", name), "element", fmt.Sprintf("%X", elem))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+
+	case TxTypeDequeue:
+		name, errResp, _ := unmarshalBytes(tx, "name", true)
+		if name == nil {
+			return errResp
+		}
+
+		elem := dequeue(tree, name)
+		if elem == nil {
+			ctx.logger.Info("DEQUEUE -> EMPTY", "queue", fmt.Sprintf("%X", name))
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrQueueEmpty,
+				Log:  fmt.Sprintf("Queue %X is empty", name),
+			}
+		}
+
+		ctx.logger.Info("DEQUEUE", "queue", fmt.Sprintf("%X", name), "element", fmt.Sprintf("%X", elem))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: elem}
+
+	case TxTypeDrain:
+		name, errResp, _ := unmarshalBytes(tx, "name", true)
+		if name == nil {
+			return errResp
+		}
+
+		var list []byte
+		for _, elem := range drain(tree, name) {
+			list = appendElement(list, elem)
+		}
+
+		ctx.logger.Info("DRAIN", "queue", fmt.Sprintf("%X", name), "elements", fmt.Sprintf("%X", list))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: list}
+
+	case TxTypeLockAcquire, TxTypeLockRenew, TxTypeLockRelease:
+		name, errResp, n := unmarshalBytes(tx, "name", false)
+		if name == nil {
+			return errResp
+		}
+		tx = tx[n:]
+
+		owner, errResp, n := unmarshalBytes(tx, "owner", false)
+		if owner == nil {
+			return errResp
+		}
+		tx = tx[n:]
+
+		// Token (except for acquire) and lease (except for release) follow.
+		var args []int64
+		for len(tx) >= 8 {
+			args = append(args, int64(binary.BigEndian.Uint64(tx[:8])))
+			tx = tx[8:]
+		}
+		wantArgs := 2
+		if typeByte == TxTypeLockAcquire || typeByte == TxTypeLockRelease {
+			wantArgs = 1
+		}
+		if len(args) != wantArgs || len(tx) > 0 {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  fmt.Sprintf("Expected %d 8-byte arguments after owner", wantArgs),
+			}
+		}
+		if typeByte != TxTypeLockRelease && args[len(args)-1] <= 0 {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  fmt.Sprintf("Lease must be positive, got %d", args[len(args)-1]),
+			}
+		}
+		if lease := args[len(args)-1]; typeByte != TxTypeLockRelease && addOverflows(workingHeight(tree), lease) {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrOverflow,
+				Log:  fmt.Sprintf("Lease %d overflows the expiry height", lease),
+			}
+		}
+
+		var res abci.ResponseDeliverTx
+		switch typeByte {
+		case TxTypeLockAcquire:
+			_, res = acquireLock(tree, name, owner, args[0])
+		case TxTypeLockRenew:
+			res = renewLock(tree, name, owner, args[0], args[1])
+		case TxTypeLockRelease:
+			res = releaseLock(tree, name, owner, args[0])
+		}
+
+		ctx.logger.Info("LOCK",
+			"type", fmt.Sprintf("%X", typeByte),
+			"name", fmt.Sprintf("%X", name),
+			"owner", fmt.Sprintf("%X", owner),
+			"args", args,
+			"code", res.Code,
+		)
+		return res
+
+	case TxTypeAclGrant, TxTypeAclRevoke:
+		prefix, errResp, n := unmarshalBytes(tx, "prefix", false)
+		if prefix == nil {
+			return errResp
+		}
+
+		pubKey, errResp, _ := unmarshalBytes(tx[n:], "pubKey", true)
+		if pubKey == nil {
+			return errResp
+		}
+		if len(pubKey) != ed25519.PubKeySize {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  fmt.Sprintf("PubKey must be %d bytes: %X is %d bytes", ed25519.PubKeySize, pubKey, len(pubKey)),
+			}
+		}
+
+		var res abci.ResponseDeliverTx
+		if typeByte == TxTypeAclGrant {
+			res = grantAccess(tree, signer, prefix, pubKey)
+		} else {
+			res = revokeAccess(tree, signer, prefix, pubKey)
+		}
+
+		ctx.logger.Info("ACL",
+			"type", fmt.Sprintf("%X", typeByte),
+			"prefix", fmt.Sprintf("%X", prefix),
+			"pubKey", fmt.Sprintf("%X", pubKey),
+			"code", res.Code,
+		)
+		return res
+
+	case TxTypeValSetChange:
+		pubKey, errResp, n := unmarshalBytes(tx, "pubKey", false)
+		if pubKey == nil {
+			return errResp
+		}
+
+		if len(pubKey) != ed25519.PubKeySize {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  fmt.Sprintf("PubKey must be %d bytes: %X is %d bytes", ed25519.PubKeySize, pubKey, len(pubKey)),
+			}
+		}
+
+		tx = tx[n:]
+		power, err := decodeInt(tx)
+		if err != nil {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  fmt.Sprintf("Can't decode power: %v", err),
+			}
+		}
+
+		ctx.logger.Info("VALSET-CHANGE",
+			"pubkey", fmt.Sprintf("%X", pubKey),
+			"power", power,
+		)
+
+		if ctx.check {
+			return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+		}
+		return app.updateValidator(pubKey, int64(power))
+
+	case TxTypeValSetRead:
+		bz, err := json.Marshal(app.state.Validators)
+		if err != nil {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeInternalError,
+				Log:  fmt.Sprintf("Marshaling error: %v", err),
+			}
+		}
+
+		ctx.logger.Info("VALSET-READ", "version", app.state.Validators.Version)
 
 		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: bz}
 
@@ -433,13 +1511,124 @@ func (app *App) doTx(tx []byte) abci.ResponseDeliverTx {
 			}
 		}
 
-		app.logger.Info("VALSET-CAS",
+		ctx.logger.Info("VALSET-CAS",
 			"pubkey", fmt.Sprintf("%X", pubKey),
 			"power", power,
 		)
 
+		if ctx.check {
+			return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+		}
 		return app.updateValidator(pubKey, int64(power))
 
+	case TxTypeAppend:
+		key, errResp, n := unmarshalBytes(tx, "key", false)
+		if key == nil {
+			return errResp
+		}
+
+		elem, errResp, _ := unmarshalBytes(tx[n:], "element", true)
+		if elem == nil {
+			return errResp
+		}
+
+		if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		_, list := tree.Get(storeKey(key))
+		if _, err := decodeList(list); err != nil {
+			ctx.logger.Info("APPEND -> NOT A LIST", "key", fmt.Sprintf("%X", key))
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrWrongType,
+				Log:  fmt.Sprintf("Value of %X is not a list: %v", key, err),
+			}
+		}
+
+		setKey(tree, key, appendElement(list, elem))
+
+		ctx.logger.Info("APPEND", "key", fmt.Sprintf("%X", key), "element", fmt.Sprintf("%X", elem))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+
+	case TxTypeListRead:
+		key, errResp, _ := unmarshalBytes(tx, "key", true)
+		if key == nil {
+			return errResp
+		}
+
+		_, list := tree.Get(storeKey(key))
+		if _, err := decodeList(list); err != nil {
+			ctx.logger.Info("LIST-READ -> NOT A LIST", "key", fmt.Sprintf("%X", key))
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrWrongType,
+				Log:  fmt.Sprintf("Value of %X is not a list: %v", key, err),
+			}
+		}
+
+		ctx.logger.Info("LIST-READ", "key", fmt.Sprintf("%X", key), "list", fmt.Sprintf("%X", list))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: list}
+
+	case TxTypeIncrement, TxTypeDecrement, TxTypeFetchAndAdd:
+		key, errResp, n := unmarshalBytes(tx, "key", typeByte != TxTypeFetchAndAdd)
+		if key == nil {
+			return errResp
+		}
+
+		var delta int64
+		switch typeByte {
+		case TxTypeIncrement:
+			delta = 1
+		case TxTypeDecrement:
+			delta = -1
+		case TxTypeFetchAndAdd:
+			tx = tx[n:]
+			if len(tx) != 8 {
+				return abci.ResponseDeliverTx{
+					Code: CodeTypeEncodingError,
+					Log:  fmt.Sprintf("Delta must be 8 bytes, got %d", len(tx)),
+				}
+			}
+			delta = int64(binary.BigEndian.Uint64(tx))
+		}
+
+		if res := authorize(tree, signer, key); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		value, res := addToCounter(tree, key, delta)
+		if res.Code != abci.CodeTypeOK {
+			ctx.logger.Info("ADD -> FAILED", "key", fmt.Sprintf("%X", key), "delta", delta)
+			return res
+		}
+
+		ctx.logger.Info("ADD", "key", fmt.Sprintf("%X", key), "delta", delta, "value", value)
+		return res
+
+	case TxTypeTxn:
+		ops, errResp := decodeTxnOps(tx)
+		if ops == nil {
+			return errResp
+		}
+		if len(ops) == 0 {
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  "Txn must contain at least one op",
+			}
+		}
+
+		if res := authorize(tree, signer, writtenKeys(ops)...); res.Code != abci.CodeTypeOK {
+			return res
+		}
+		reads, err := applyTxnOps(tree, ops)
+		if err != nil {
+			ctx.logger.Info("TXN -> NOT A LIST", "err", err)
+			return abci.ResponseDeliverTx{
+				Code: CodeTypeErrWrongType,
+				Log:  fmt.Sprintf("Can't apply txn: %v", err),
+			}
+		}
+
+		ctx.logger.Info("TXN", "ops", fmt.Sprintf("%v", ops))
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: reads}
+
 	default:
 		return abci.ResponseDeliverTx{
 			Code: CodeTypeErrUnknownRequest,
@@ -448,20 +1637,33 @@ func (app *App) doTx(tx []byte) abci.ResponseDeliverTx {
 	}
 }
 
+// decodeTxExpiry decodes the expiry which ends an expiring transaction and
+// checks that it hasn't passed yet.
+func (app *App) decodeTxExpiry(bz []byte) (expiry, abci.ResponseDeliverTx) {
+	e, err := decodeExpiry(bz)
+	if err != nil {
+		return e, abci.ResponseDeliverTx{
+			Code: CodeTypeEncodingError,
+			Log:  fmt.Sprintf("Can't decode expiry: %v", err),
+		}
+	}
+	if e.passed(app.state.Height+1, app.blockTime) {
+		return e, abci.ResponseDeliverTx{
+			Code: CodeTypeErrExpiryPassed,
+			Log:  fmt.Sprintf("Expiry %v has already passed", e),
+		}
+	}
+	return e, abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+}
+
 func (app *App) updateValidator(pubKey []byte, power int64) abci.ResponseDeliverTx {
 	v := &Validator{PubKey: ed25519.PubKey(pubKey), Power: power}
-	if v.Power == 0 {
-		// remove validator
-		if !app.state.Validators.Has(v) {
-			return abci.ResponseDeliverTx{
-				Code: CodeTypeErrUnauthorized,
-				Log:  fmt.Sprintf("Cannot remove non-existent validator %v", v),
-			}
+	// add, update or remove (if power is zero) the validator
+	if !app.state.SetValidator(v) {
+		return abci.ResponseDeliverTx{
+			Code: CodeTypeErrUnauthorized,
+			Log:  fmt.Sprintf("Cannot remove non-existent validator %v", v),
 		}
-		app.state.Validators.Remove(v)
-	} else {
-		// add or update validator
-		app.state.Validators.Set(v)
 	}
 
 	pk, err := cryptoenc.PubKeyToProto(v.PubKey)
@@ -501,10 +1703,11 @@ func unmarshalBytes(buf []byte, key string, checkNoMoreBytes bool) ([]byte, abci
 		}, n
 	}
 
-	if left, want := len(buf), n+length; left < want {
+	// compare against the bytes left, since n+length may overflow
+	if left := len(buf) - n; length > left {
 		return nil, abci.ResponseDeliverTx{
 			Code: CodeTypeEncodingError,
-			Log:  fmt.Sprintf("Not enough bytes %s: %d left, wanted %d", key, left, want),
+			Log:  fmt.Sprintf("Not enough bytes %s: %d left, wanted %d", key, left, length),
 		}, n
 	}
 
@@ -519,6 +1722,33 @@ func unmarshalBytes(buf []byte, key string, checkNoMoreBytes bool) ([]byte, abci
 	return bytes, abci.ResponseDeliverTx{}, n + length
 }
 
+// decodeBytes decodes a length-prefixed byte array, which may be empty. It
+// returns the bytes and the number of bytes read.
+func decodeBytes(buf []byte) ([]byte, int, error) {
+	length, n := decodeVarint(buf)
+	if n <= 0 {
+		return nil, n, errors.New("buf too small or length larger than 64bits")
+	}
+	// compare against the bytes left, since n+length may overflow
+	if left := len(buf) - n; length < 0 || length > left {
+		return nil, n, fmt.Errorf("not enough bytes: %d left, wanted %d", left, length)
+	}
+
+	bytes := make([]byte, length)
+	copy(bytes, buf[n:(n+length)])
+
+	return bytes, n + length, nil
+}
+
+// encodeBytes length-prefixes b, so that it can be decoded with
+// unmarshalBytes or decodeBytes.
+func encodeBytes(b []byte) []byte {
+	lenBz := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lenBz, uint64(len(b)))
+
+	return append(lenBz[:n], b...)
+}
+
 // minimum length is 12 (nonce) + 1 (type byte) = 13
 func minTxLen() int {
 	return NonceLength + 1
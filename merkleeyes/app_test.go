@@ -1,10 +1,20 @@
 package merkleeyes_test
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/cosmos/iavl"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -12,7 +22,11 @@ import (
 	"github.com/tendermint/tendermint/crypto"
 	"github.com/tendermint/tendermint/crypto/ed25519"
 	cryptoenc "github.com/tendermint/tendermint/crypto/encoding"
+	"github.com/tendermint/tendermint/crypto/merkle"
 	"github.com/tendermint/tendermint/libs/log"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
+
+	dbm "github.com/tendermint/tm-db"
 
 	merkleeyes "github.com/melekes/jepsen/merkleeyes"
 )
@@ -89,6 +103,1322 @@ func TestMerkleEyesApp(t *testing.T) {
 	assert.NotEqual(t, resCommit.Data, res1.LastBlockAppHash)
 }
 
+func TestQueryHistoricalHeight(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	// height 1: foo=bar, height 2: foo=baz
+	for _, v := range []string{"bar", "baz"} {
+		app.BeginBlock(abci.RequestBeginBlock{})
+		res := app.DeliverTx(abci.RequestDeliverTx{Tx: setTx([]byte("foo"), []byte(v))})
+		require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+		app.EndBlock(abci.RequestEndBlock{})
+		app.Commit()
+	}
+
+	resQ := app.Query(abci.RequestQuery{Path: "/key", Data: []byte("foo")})
+	assert.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	assert.EqualValues(t, 2, resQ.Height)
+	assert.Equal(t, []byte("baz"), resQ.Value)
+
+	resQ = app.Query(abci.RequestQuery{Path: "/key", Data: []byte("foo"), Height: 1})
+	assert.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	assert.EqualValues(t, 1, resQ.Height)
+	assert.Equal(t, []byte("bar"), resQ.Value)
+
+	resQ = app.Query(abci.RequestQuery{Path: "/key", Data: []byte("foo"), Height: 3})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrUnknownHeight, resQ.Code, resQ.Log)
+}
+
+func TestQueryWithProof(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: setTx([]byte("foo"), []byte("bar"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	app.EndBlock(abci.RequestEndBlock{})
+	appHash := app.Commit().Data
+
+	prt := merkle.NewProofRuntime()
+	prt.RegisterOpDecoder(iavl.ProofOpIAVLValue, iavl.ValueOpDecoder)
+	prt.RegisterOpDecoder(iavl.ProofOpIAVLAbsence, iavl.AbsenceOpDecoder)
+
+	// existence
+	resQ := app.Query(abci.RequestQuery{Path: "/key", Data: []byte("foo"), Prove: true})
+	require.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	require.NotNil(t, resQ.ProofOps)
+	keyPath := merkle.KeyPath{}.AppendKey([]byte("/key/foo"), merkle.KeyEncodingURL).String()
+	assert.NoError(t, prt.VerifyValue(resQ.ProofOps, appHash, keyPath, resQ.Value))
+	assert.Error(t, prt.VerifyValue(resQ.ProofOps, appHash, keyPath, []byte("baz")))
+
+	// absence
+	resQ = app.Query(abci.RequestQuery{Path: "/key", Data: []byte("qux"), Prove: true})
+	require.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, resQ.Code, resQ.Log)
+	require.NotNil(t, resQ.ProofOps)
+	keyPath = merkle.KeyPath{}.AppendKey([]byte("/key/qux"), merkle.KeyEncodingURL).String()
+	assert.NoError(t, prt.VerifyAbsence(resQ.ProofOps, appHash, keyPath))
+}
+
+func TestQueryRange(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	for _, k := range []string{"a1", "a2", "a3", "b1", "c1"} {
+		res := app.DeliverTx(abci.RequestDeliverTx{Tx: setTx([]byte(k), []byte("v"+k))})
+		require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	}
+	app.EndBlock(abci.RequestEndBlock{})
+	app.Commit()
+
+	scan := func(path string, args [][]byte, reverse bool, limit uint64) []string {
+		var keys []string
+		var cursor []byte
+		for {
+			var data []byte
+			for _, a := range args {
+				data = append(data, encodeBytes(a)...)
+			}
+			data = append(data, encodeBytes(cursor)...)
+			if reverse {
+				data = append(data, 0x01)
+			} else {
+				data = append(data, 0x00)
+			}
+			data = append(data, encodeUvarint(limit)...)
+
+			res := app.Query(abci.RequestQuery{Path: path, Data: data})
+			require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+			for _, kv := range decodePairs(t, res.Value) {
+				assert.Equal(t, "v"+string(kv[0]), string(kv[1]))
+				keys = append(keys, string(kv[0]))
+			}
+			if len(res.Key) == 0 {
+				return keys
+			}
+			cursor = res.Key
+		}
+	}
+
+	assert.Equal(t, []string{"a1", "a2", "a3", "b1", "c1"}, scan("/range", [][]byte{nil, nil}, false, 0))
+	assert.Equal(t, []string{"a2", "a3", "b1"}, scan("/range", [][]byte{[]byte("a2"), []byte("c1")}, false, 2))
+	assert.Equal(t, []string{"b1", "a3", "a2"}, scan("/range", [][]byte{[]byte("a2"), []byte("c1")}, true, 2))
+	assert.Equal(t, []string{"a1", "a2", "a3"}, scan("/prefix", [][]byte{[]byte("a")}, false, 1))
+	assert.Equal(t, []string{"a3", "a2", "a1"}, scan("/prefix", [][]byte{[]byte("a")}, true, 2))
+	assert.Empty(t, scan("/prefix", [][]byte{[]byte("d")}, false, 0))
+
+	// malformed queries fail without panicking
+	for _, data := range [][]byte{
+		nil,
+		encodeUvarint(math.MaxInt64),
+		encodeUvarint(math.MaxUint64),
+		append(encodeBytes([]byte("a")), encodeUvarint(math.MaxInt64)...),
+	} {
+		for _, path := range []string{"/range", "/prefix"} {
+			res := app.Query(abci.RequestQuery{Path: path, Data: data})
+			assert.EqualValues(t, merkleeyes.CodeTypeEncodingError, res.Code, "%s %X", path, data)
+		}
+	}
+}
+
+func TestPruning(t *testing.T) {
+	opts, err := merkleeyes.NewPruningOptions(merkleeyes.PruningCustom, 2, 3)
+	require.NoError(t, err)
+	app, err := merkleeyes.New(t.TempDir(), 0, merkleeyes.WithPruning(opts))
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	for i := 1; i <= 6; i++ {
+		res := deliverBlock(app, setTx([]byte("foo"), []byte{byte(i)}))
+		require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+	}
+
+	for h, kept := range map[int64]bool{1: false, 2: false, 3: true, 4: false, 5: true, 6: true} {
+		resQ := app.Query(abci.RequestQuery{Path: "/key", Data: []byte("foo"), Height: h})
+		if !kept {
+			assert.EqualValues(t, merkleeyes.CodeTypeErrUnknownHeight, resQ.Code, "height %d", h)
+			assert.Contains(t, resQ.Log, "pruned")
+			continue
+		}
+		require.Equal(t, abci.CodeTypeOK, resQ.Code, "height %d: %s", h, resQ.Log)
+		assert.Equal(t, []byte{byte(h)}, resQ.Value)
+	}
+
+	_, err = merkleeyes.NewPruningOptions(merkleeyes.PruningCustom, 0, 0)
+	assert.Error(t, err)
+
+	// heights kept under earlier options are pruned after a restart
+	dir := t.TempDir()
+	app, err = merkleeyes.New(dir, 0)
+	require.NoError(t, err)
+	for i := 1; i <= 5; i++ {
+		deliverBlock(app, setTx([]byte("foo"), []byte{byte(i)}))
+	}
+	app.CloseDB()
+	opts, err = merkleeyes.NewPruningOptions(merkleeyes.PruningEverything, 0, 0)
+	require.NoError(t, err)
+	app, err = merkleeyes.New(dir, 0, merkleeyes.WithPruning(opts))
+	require.NoError(t, err)
+	defer app.CloseDB()
+	deliverBlock(app, setTx([]byte("foo"), []byte{6}))
+	for h := int64(1); h <= 5; h++ {
+		resQ := app.Query(abci.RequestQuery{Path: "/key", Data: []byte("foo"), Height: h})
+		assert.EqualValues(t, merkleeyes.CodeTypeErrUnknownHeight, resQ.Code, "height %d", h)
+		assert.Contains(t, resQ.Log, "pruned")
+	}
+	resQ := app.Query(abci.RequestQuery{Path: "/key", Data: []byte("foo"), Height: 6})
+	require.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	assert.Equal(t, []byte{6}, resQ.Value)
+}
+
+func TestReceipts(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	set := setTx([]byte("foo"), []byte("bar"))
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: set})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	get := readTx([]byte("foo"))
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: get})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	getEvents := res.Events
+	require.NotEmpty(t, getEvents)
+	cas := casTx([]byte("foo"), []byte("baz"), []byte("qux"))
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: cas})
+	require.EqualValues(t, merkleeyes.CodeTypeErrUnauthorized, res.Code, res.Log)
+	// a tx which fails to execute stores a receipt, a malformed one doesn't
+	appendFoo := appendTx([]byte("foo"), []byte("1"))
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: appendFoo})
+	require.EqualValues(t, merkleeyes.CodeTypeErrWrongType, res.Code, res.Log)
+	malformed := append(setTx([]byte("foo"), []byte("bar")), 0x00)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: malformed})
+	require.EqualValues(t, merkleeyes.CodeTypeEncodingError, res.Code, res.Log)
+	app.EndBlock(abci.RequestEndBlock{})
+	app.Commit()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: setTx([]byte("foo"), []byte("baz"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	// resubmitting returns the original result (and events) without executing
+	// the tx again
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: get})
+	assert.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, []byte("bar"), res.Data)
+	assert.Equal(t, getEvents, res.Events)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: cas})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrUnauthorized, res.Code, res.Log)
+	app.EndBlock(abci.RequestEndBlock{})
+	app.Commit()
+
+	resQ := app.Query(abci.RequestQuery{Path: "/receipt", Data: get[:merkleeyes.NonceLength]})
+	require.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	var receipt merkleeyes.Receipt
+	require.NoError(t, json.Unmarshal(resQ.Value, &receipt))
+	assert.Equal(t, merkleeyes.Receipt{Code: abci.CodeTypeOK, Data: []byte("bar"), Events: getEvents, Height: 1}, receipt)
+
+	resQ = app.Query(abci.RequestQuery{Path: "/receipt", Data: appendFoo[:merkleeyes.NonceLength]})
+	require.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	require.NoError(t, json.Unmarshal(resQ.Value, &receipt))
+	assert.EqualValues(t, merkleeyes.CodeTypeErrWrongType, receipt.Code)
+
+	for _, nonce := range [][]byte{malformed[:merkleeyes.NonceLength], make([]byte, merkleeyes.NonceLength)} {
+		resQ = app.Query(abci.RequestQuery{Path: "/receipt", Data: nonce})
+		assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, resQ.Code, resQ.Log)
+	}
+}
+
+func TestNonceWindow(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0, merkleeyes.WithNonceWindow(2))
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	block := func(txs ...[]byte) []abci.ResponseDeliverTx { return deliverBlock(app, txs...) }
+	receipt := func(tx []byte) uint32 {
+		return app.Query(abci.RequestQuery{Path: "/receipt", Data: tx[:merkleeyes.NonceLength]}).Code
+	}
+	// atHeight sets the height at the start of the nonce of tx
+	atHeight := func(height uint64, tx []byte) []byte {
+		tx = append([]byte{}, tx...)
+		copy(tx, encodeUint64(height))
+		return tx
+	}
+
+	// height 1: a tx which fails to decode doesn't consume its nonce, and a
+	// nonce height must be below the current height
+	counter := atHeight(0, counterTx(merkleeyes.TxTypeIncrement, []byte("c")))
+	bad := append(append([]byte{}, counter[:merkleeyes.NonceLength]...), 0xFF)
+	res := block(bad, counter, atHeight(1, counterTx(merkleeyes.TxTypeIncrement, []byte("c"))))
+	assert.EqualValues(t, merkleeyes.CodeTypeErrUnknownRequest, res[0].Code, res[0].Log)
+	require.Equal(t, abci.CodeTypeOK, res[1].Code, res[1].Log)
+	assert.EqualValues(t, merkleeyes.CodeTypeBadNonce, res[2].Code, res[2].Log)
+
+	// height 2: still within the window
+	res = block(counter)
+	assert.Equal(t, encodeUint64(1), res[0].Data)
+	assert.Equal(t, abci.CodeTypeOK, receipt(counter))
+
+	// height 3: the window has ended, so the nonce was pruned and the tx is
+	// rejected instead of executing again
+	assert.EqualValues(t, merkleeyes.CodeTypeBadNonce, app.CheckTx(abci.RequestCheckTx{Tx: counter}).Code)
+	res = block(counter, atHeight(1, counterTx(merkleeyes.TxTypeIncrement, []byte("c"))))
+	assert.EqualValues(t, merkleeyes.CodeTypeBadNonce, res[0].Code, res[0].Log)
+	require.Equal(t, abci.CodeTypeOK, res[1].Code, res[1].Log)
+	assert.Equal(t, encodeUint64(2), res[1].Data)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, receipt(counter))
+}
+
+func TestSignedTx(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.InitChain(abci.RequestInitChain{ChainId: "test-chain"})
+	priv := ed25519.GenPrivKey()
+
+	signedTx := func(chainID string, seq int64, inner []byte) []byte {
+		return signTx(t, priv, chainID, seq, inner)
+	}
+
+	first := signedTx("test-chain", 0, setTx([]byte("foo"), []byte("bar")))
+	resC := app.CheckTx(abci.RequestCheckTx{Tx: first})
+	assert.Equal(t, abci.CodeTypeOK, resC.Code, resC.Log)
+	forged := signedTx("other-chain", 1, setTx([]byte("foo"), []byte("baz")))
+	resC = app.CheckTx(abci.RequestCheckTx{Tx: forged})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBadSignature, resC.Code, resC.Log)
+
+	res := deliverBlock(app,
+		first,
+		forged,
+		signedTx("test-chain", 0, setTx([]byte("foo"), []byte("baz"))),
+		signedTx("test-chain", 1, readTx([]byte("foo"))),
+	)
+	require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+	require.Len(t, res[0].Events, 1)
+	assert.Equal(t, "tx", res[0].Events[0].Type)
+	assert.Equal(t, []byte("sender"), res[0].Events[0].Attributes[0].Key)
+	assert.Equal(t, []byte(fmt.Sprintf("%X", priv.PubKey().Bytes())), res[0].Events[0].Attributes[0].Value)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBadSignature, res[1].Code, res[1].Log)
+	// the sequence number was used already
+	assert.EqualValues(t, merkleeyes.CodeTypeBadNonce, res[2].Code, res[2].Log)
+	require.Equal(t, abci.CodeTypeOK, res[3].Code, res[3].Log)
+	assert.Equal(t, []byte("bar"), res[3].Data)
+
+	resQ := app.Query(abci.RequestQuery{Path: "/account", Data: priv.PubKey().Bytes()})
+	require.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	assert.Equal(t, encodeUint64(2), resQ.Value)
+
+	// a replayed signed tx emits the same events, including the sender
+	replayed := deliverBlock(app, first)
+	assert.Equal(t, abci.CodeTypeOK, replayed[0].Code, replayed[0].Log)
+	assert.Equal(t, res[0].Events, replayed[0].Events)
+}
+
+func TestChainID(t *testing.T) {
+	dir := t.TempDir()
+	priv := ed25519.GenPrivKey()
+
+	// a database without a chain ID, which won't see InitChain again
+	app, err := merkleeyes.New(dir, 0)
+	require.NoError(t, err)
+	res := deliverBlock(app, signTx(t, priv, "", 0, setTx([]byte("foo"), []byte("bar"))))
+	require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+	app.CloseDB()
+
+	app, err = merkleeyes.New(dir, 0, merkleeyes.WithChainID("test-chain"))
+	require.NoError(t, err)
+	app.CloseDB()
+
+	// the chain ID is persisted
+	app, err = merkleeyes.New(dir, 0)
+	require.NoError(t, err)
+	res = deliverBlock(app,
+		signTx(t, priv, "", 1, setTx([]byte("foo"), []byte("baz"))),
+		signTx(t, priv, "test-chain", 1, setTx([]byte("foo"), []byte("baz"))),
+	)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBadSignature, res[0].Code, res[0].Log)
+	require.Equal(t, abci.CodeTypeOK, res[1].Code, res[1].Log)
+	app.CloseDB()
+
+	_, err = merkleeyes.New(dir, 0, merkleeyes.WithChainID("other-chain"))
+	assert.Error(t, err)
+}
+
+func TestACL(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.InitChain(abci.RequestInitChain{ChainId: "test-chain"})
+	alice, bob := ed25519.GenPrivKey(), ed25519.GenPrivKey()
+	aclTx := func(typ byte, prefix []byte, pubKey crypto.PubKey) []byte {
+		return newTx(typ, prefix, pubKey.Bytes())
+	}
+
+	res := deliverBlock(app,
+		signTx(t, alice, "test-chain", 0, aclTx(merkleeyes.TxTypeAclGrant, []byte("a/"), alice.PubKey())),
+		signTx(t, bob, "test-chain", 0, setTx([]byte("a/x"), []byte("1"))),
+		setTx([]byte("a/x"), []byte("1")),
+		signTx(t, alice, "test-chain", 1, setTx([]byte("a/x"), []byte("1"))),
+		setTx([]byte("b/x"), []byte("1")),
+		signTx(t, bob, "test-chain", 1, aclTx(merkleeyes.TxTypeAclGrant, []byte("a/b/"), bob.PubKey())),
+		signTx(t, alice, "test-chain", 2, aclTx(merkleeyes.TxTypeAclGrant, []byte("a/b/"), bob.PubKey())),
+		signTx(t, bob, "test-chain", 2, setTx([]byte("a/b/y"), []byte("1"))),
+		signTx(t, bob, "test-chain", 3, newTx(merkleeyes.TxTypeRmPrefix, []byte("a/"))),
+		readTx([]byte("a/x")),
+	)
+	codes := make([]uint32, len(res))
+	for i, r := range res {
+		codes[i] = r.Code
+	}
+	assert.Equal(t, []uint32{
+		abci.CodeTypeOK,
+		merkleeyes.CodeTypeErrUnauthorized,
+		merkleeyes.CodeTypeErrUnauthorized,
+		abci.CodeTypeOK,
+		abci.CodeTypeOK,
+		merkleeyes.CodeTypeErrUnauthorized,
+		abci.CodeTypeOK,
+		abci.CodeTypeOK,
+		merkleeyes.CodeTypeErrUnauthorized,
+		abci.CodeTypeOK,
+	}, codes)
+
+	resQ := app.Query(abci.RequestQuery{Path: "/acl", Data: []byte("a/b/")})
+	require.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	assert.Equal(t, [][]byte{bob.PubKey().Bytes()}, decodeList(t, resQ.Value))
+
+	// unowned prefixes covering existing keys can't be claimed, and owners of
+	// a prefix can revoke grants of sub-prefixes
+	carol := ed25519.GenPrivKey()
+	res = deliverBlock(app,
+		signTx(t, carol, "test-chain", 0, aclTx(merkleeyes.TxTypeAclGrant, []byte("a"), carol.PubKey())),
+		signTx(t, carol, "test-chain", 1, aclTx(merkleeyes.TxTypeAclGrant, []byte("b"), carol.PubKey())),
+		signTx(t, carol, "test-chain", 2, aclTx(merkleeyes.TxTypeAclGrant, []byte("c/"), carol.PubKey())),
+		signTx(t, carol, "test-chain", 3, aclTx(merkleeyes.TxTypeAclRevoke, []byte("a/b/"), bob.PubKey())),
+		signTx(t, alice, "test-chain", 3, aclTx(merkleeyes.TxTypeAclRevoke, []byte("a/b/"), bob.PubKey())),
+		signTx(t, alice, "test-chain", 4, setTx([]byte("a/b/y"), []byte("2"))),
+		signTx(t, bob, "test-chain", 4, setTx([]byte("a/b/y"), []byte("3"))),
+	)
+	for i, code := range []uint32{
+		merkleeyes.CodeTypeErrUnauthorized,
+		merkleeyes.CodeTypeErrUnauthorized,
+		abci.CodeTypeOK,
+		merkleeyes.CodeTypeErrUnauthorized,
+		abci.CodeTypeOK,
+		abci.CodeTypeOK,
+		merkleeyes.CodeTypeErrUnauthorized,
+	} {
+		assert.Equal(t, code, res[i].Code, "tx %d: %s", i, res[i].Log)
+	}
+	resQ = app.Query(abci.RequestQuery{Path: "/acl", Data: []byte("a/b/")})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, resQ.Code, resQ.Log)
+
+	// once the last owner is revoked, the prefix is open again
+	res = deliverBlock(app,
+		signTx(t, bob, "test-chain", 5, aclTx(merkleeyes.TxTypeAclRevoke, []byte("a/"), alice.PubKey())),
+		signTx(t, alice, "test-chain", 5, aclTx(merkleeyes.TxTypeAclRevoke, []byte("a/"), alice.PubKey())),
+		setTx([]byte("a/x"), []byte("2")),
+	)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrUnauthorized, res[0].Code, res[0].Log)
+	assert.Equal(t, abci.CodeTypeOK, res[1].Code, res[1].Log)
+	assert.Equal(t, abci.CodeTypeOK, res[2].Code, res[2].Log)
+}
+
+func TestCheckTx(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.InitChain(abci.RequestInitChain{ChainId: "test-chain"})
+	priv := ed25519.GenPrivKey()
+	check := func(tx []byte, typ abci.CheckTxType) uint32 {
+		return app.CheckTx(abci.RequestCheckTx{Tx: tx, Type: typ}).Code
+	}
+
+	set := setTx([]byte("foo"), []byte("bar"))
+	pending := setTx([]byte("foo"), []byte("baz"))
+	badType := newTx(0xFF, []byte("foo"))
+	badValue := newTx(merkleeyes.TxTypeSet, []byte("foo"))
+	assert.EqualValues(t, merkleeyes.CodeTypeEncodingError, check([]byte{0x01}, abci.CheckTxType_New))
+	assert.EqualValues(t, merkleeyes.CodeTypeErrUnknownRequest, check(badType, abci.CheckTxType_New))
+	assert.EqualValues(t, merkleeyes.CodeTypeEncodingError, check(badValue, abci.CheckTxType_New))
+	// overflowing length prefixes are rejected without panicking
+	for _, length := range []uint64{math.MaxInt64, math.MaxInt64 - 1, math.MaxUint64} {
+		nonce := make([]byte, merkleeyes.NonceLength)
+		tx := concat(nonce, []byte{merkleeyes.TxTypeSet}, encodeUvarint(length))
+		assert.EqualValues(t, merkleeyes.CodeTypeEncodingError, check(tx, abci.CheckTxType_New))
+		tx = concat(nonce, []byte{merkleeyes.TxTypeSet}, encodeBytes([]byte("foo")), encodeUvarint(length))
+		assert.EqualValues(t, merkleeyes.CodeTypeEncodingError, check(tx, abci.CheckTxType_New))
+	}
+	assert.Equal(t, abci.CodeTypeOK, check(set, abci.CheckTxType_New))
+	assert.EqualValues(t, merkleeyes.CodeTypeBadNonce, check(set, abci.CheckTxType_New))
+	assert.Equal(t, abci.CodeTypeOK, check(pending, abci.CheckTxType_New))
+
+	// sequence numbers advance in the check state
+	assert.Equal(t, abci.CodeTypeOK, check(signTx(t, priv, "test-chain", 0, readTx([]byte("foo"))), abci.CheckTxType_New))
+	assert.Equal(t, abci.CodeTypeOK, check(signTx(t, priv, "test-chain", 1, readTx([]byte("foo"))), abci.CheckTxType_New))
+	assert.EqualValues(t, merkleeyes.CodeTypeBadNonce,
+		check(signTx(t, priv, "test-chain", 1, readTx([]byte("foo"))), abci.CheckTxType_New))
+
+	// validator set changes aren't applied
+	assert.Equal(t, abci.CodeTypeOK, check(valsetChangeTx(ed25519.GenPrivKey().PubKey(), 10), abci.CheckTxType_New))
+	assert.Empty(t, app.ValidatorSetState().Validators)
+
+	get := readTx([]byte("foo"))
+	failed := casTx([]byte("foo"), []byte("qux"), []byte("quux"))
+	res := deliverBlock(app, set, get, failed)
+	require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+
+	// the check state was reset: the included txs are rejected (carrying their
+	// receipts), the pending one is still valid
+	resC := app.CheckTx(abci.RequestCheckTx{Tx: get, Type: abci.CheckTxType_New})
+	assert.EqualValues(t, merkleeyes.CodeTypeBadNonce, resC.Code, resC.Log)
+	assert.Equal(t, []byte("bar"), resC.Data)
+	resC = app.CheckTx(abci.RequestCheckTx{Tx: failed, Type: abci.CheckTxType_New})
+	assert.EqualValues(t, merkleeyes.CodeTypeBadNonce, resC.Code, resC.Log)
+	assert.Contains(t, resC.Log, fmt.Sprintf("with code %d", merkleeyes.CodeTypeErrUnauthorized))
+	assert.EqualValues(t, merkleeyes.CodeTypeBadNonce, check(set, abci.CheckTxType_Recheck))
+	assert.Equal(t, abci.CodeTypeOK, check(pending, abci.CheckTxType_Recheck))
+	assert.Equal(t, abci.CodeTypeOK, check(signTx(t, priv, "test-chain", 0, readTx([]byte("foo"))), abci.CheckTxType_Recheck))
+}
+
+func TestStateRecovery(t *testing.T) {
+	dir := t.TempDir()
+	app, err := merkleeyes.New(dir, 0)
+	require.NoError(t, err)
+	deliverBlock(app, setTx([]byte("foo"), []byte("1")))
+	deliverBlock(app, setTx([]byte("foo"), []byte("2")))
+	info := app.Info(abci.RequestInfo{})
+	app.CloseDB()
+
+	withDB := func(fn func(db dbm.DB)) {
+		db, err := dbm.NewGoLevelDB("merkleeyes", dir)
+		require.NoError(t, err)
+		fn(db)
+		require.NoError(t, db.Close())
+	}
+	auxStateKey := func(version uint64) []byte {
+		return append([]byte("merkleeyes:state/"), encodeUint64(version)...)
+	}
+
+	// crash after saving the state of the next version, but before saving the
+	// tree
+	withDB(func(db dbm.DB) {
+		require.NoError(t, db.Set(auxStateKey(4), []byte(`{"height":3,"validators":{}}`)))
+	})
+	app, err = merkleeyes.New(dir, 0)
+	require.NoError(t, err)
+	assert.Equal(t, info, app.Info(abci.RequestInfo{}))
+	res := deliverBlock(app, setTx([]byte("foo"), []byte("3")))
+	require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+	assert.EqualValues(t, 3, app.Info(abci.RequestInfo{}).LastBlockHeight)
+	app.CloseDB()
+
+	// a state which can't be reconciled with the tree
+	withDB(func(db dbm.DB) {
+		require.NoError(t, db.Delete(auxStateKey(4)))
+		require.NoError(t, db.Set([]byte("merkleeyes:state"), []byte(`{"height":2,"validators":{}}`)))
+	})
+	_, err = merkleeyes.New(dir, 0)
+	assert.True(t, errors.Is(err, merkleeyes.ErrStateMismatch), err)
+}
+
+func TestValidatorsInTree(t *testing.T) {
+	dir := t.TempDir()
+	app, err := merkleeyes.New(dir, 0)
+	require.NoError(t, err)
+
+	priv := ed25519.GenPrivKey()
+	pubKey, err := cryptoenc.PubKeyToProto(priv.PubKey())
+	require.NoError(t, err)
+	app.InitChain(abci.RequestInitChain{Validators: []abci.ValidatorUpdate{{PubKey: pubKey, Power: 1}}})
+	deliverBlock(app)
+	appHash := app.Info(abci.RequestInfo{}).LastBlockAppHash
+
+	// the validator set is covered by the app hash
+	resQ := app.Query(abci.RequestQuery{Path: "/validator", Data: priv.PubKey().Bytes(), Prove: true})
+	require.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	assert.Equal(t, encodeUint64(1), resQ.Value)
+	prt := merkle.NewProofRuntime()
+	prt.RegisterOpDecoder(iavl.ProofOpIAVLValue, iavl.ValueOpDecoder)
+	keyPath := merkle.KeyPath{}.AppendKey(append([]byte("/val/"), priv.PubKey().Bytes()...), merkle.KeyEncodingURL).String()
+	assert.NoError(t, prt.VerifyValue(resQ.ProofOps, appHash, keyPath, resQ.Value))
+
+	res := deliverBlock(app, valsetChangeTx(priv.PubKey(), 5))
+	require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+	assert.NotEqual(t, appHash, app.Info(abci.RequestInfo{}).LastBlockAppHash)
+
+	resQ = app.Query(abci.RequestQuery{Path: "/validators"})
+	require.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	var vss merkleeyes.ValidatorSetState
+	require.NoError(t, json.Unmarshal(resQ.Value, &vss))
+	assert.Equal(t, merkleeyes.ValidatorSetState{
+		Version:    1,
+		Validators: []*merkleeyes.Validator{{PubKey: priv.PubKey().(ed25519.PubKey), Power: 5}},
+	}, vss)
+	// only single validators can be proven
+	resQ = app.Query(abci.RequestQuery{Path: "/validators", Prove: true})
+	assert.EqualValues(t, merkleeyes.CodeTypeUnknownRequest, resQ.Code, resQ.Log)
+	assert.Nil(t, resQ.Value)
+	app.CloseDB()
+
+	// without a validator set, nothing is found
+	empty, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	deliverBlock(empty)
+	resQ = empty.Query(abci.RequestQuery{Path: "/validators"})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, resQ.Code, resQ.Log)
+	assert.Nil(t, resQ.Value)
+	empty.CloseDB()
+
+	// the validator set is loaded from the tree
+	app, err = merkleeyes.New(dir, 0)
+	require.NoError(t, err)
+	assert.Equal(t, &vss, app.ValidatorSetState())
+	app.CloseDB()
+
+	// a validator set stored by an older version is moved into the tree
+	dir = t.TempDir()
+	app, err = merkleeyes.New(dir, 0)
+	require.NoError(t, err)
+	app.CloseDB()
+	db, err := dbm.NewGoLevelDB("merkleeyes", dir)
+	require.NoError(t, err)
+	legacy, err := json.Marshal(map[string]interface{}{"height": 0, "validators": vss})
+	require.NoError(t, err)
+	require.NoError(t, db.Delete(append([]byte("merkleeyes:state/"), encodeUint64(1)...)))
+	require.NoError(t, db.Set([]byte("merkleeyes:state"), legacy))
+	require.NoError(t, db.Close())
+
+	app, err = merkleeyes.New(dir, 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+	assert.Equal(t, &vss, app.ValidatorSetState())
+	deliverBlock(app)
+	resQ = app.Query(abci.RequestQuery{Path: "/validator", Data: priv.PubKey().Bytes()})
+	assert.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+}
+
+func TestStateSync(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0, merkleeyes.WithSnapshots(2, 2))
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	priv := ed25519.GenPrivKey()
+	pubKey, err := cryptoenc.PubKeyToProto(priv.PubKey())
+	require.NoError(t, err)
+	app.InitChain(abci.RequestInitChain{
+		ChainId:    "test-chain",
+		Validators: []abci.ValidatorUpdate{{PubKey: pubKey, Power: 1}},
+	})
+	var appHash []byte
+	for i := 1; i <= 5; i++ {
+		res := deliverBlock(app, setTx([]byte(fmt.Sprintf("k%d", i)), []byte("v")))
+		require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+		if i == 4 {
+			appHash = app.Info(abci.RequestInfo{}).LastBlockAppHash
+		}
+	}
+
+	// snapshots at heights 4 and 2 are kept
+	snapshots := app.ListSnapshots(abci.RequestListSnapshots{}).Snapshots
+	require.Len(t, snapshots, 2)
+	assert.EqualValues(t, 4, snapshots[0].Height)
+	assert.EqualValues(t, 2, snapshots[1].Height)
+	snapshot := snapshots[0]
+
+	target, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer target.CloseDB()
+
+	restore := func(appHash []byte) abci.ResponseApplySnapshotChunk_Result {
+		resO := target.OfferSnapshot(abci.RequestOfferSnapshot{Snapshot: snapshot, AppHash: appHash})
+		require.Equal(t, abci.ResponseOfferSnapshot_ACCEPT, resO.Result)
+		var resA abci.ResponseApplySnapshotChunk
+		for i := uint32(0); i < snapshot.Chunks; i++ {
+			chunk := app.LoadSnapshotChunk(abci.RequestLoadSnapshotChunk{
+				Height: snapshot.Height, Format: snapshot.Format, Chunk: i,
+			}).Chunk
+			require.NotEmpty(t, chunk)
+
+			// a corrupted chunk is refetched
+			corrupted := append([]byte{}, chunk...)
+			corrupted[0]++
+			resA = target.ApplySnapshotChunk(abci.RequestApplySnapshotChunk{Index: i, Chunk: corrupted, Sender: "bad"})
+			require.Equal(t, abci.ResponseApplySnapshotChunk_RETRY, resA.Result)
+			assert.Equal(t, []string{"bad"}, resA.RejectSenders)
+
+			resA = target.ApplySnapshotChunk(abci.RequestApplySnapshotChunk{Index: i, Chunk: chunk})
+		}
+		return resA.Result
+	}
+
+	// an app hash mismatch rejects the snapshot and leaves the state empty
+	assert.Equal(t, abci.ResponseApplySnapshotChunk_REJECT_SNAPSHOT, restore([]byte("wrong")))
+	assert.EqualValues(t, 0, target.Info(abci.RequestInfo{}).LastBlockHeight)
+
+	require.Equal(t, abci.ResponseApplySnapshotChunk_ACCEPT, restore(appHash))
+	info := target.Info(abci.RequestInfo{})
+	assert.EqualValues(t, 4, info.LastBlockHeight)
+	assert.Equal(t, appHash, info.LastBlockAppHash)
+	assert.Equal(t, app.ValidatorSetState(), target.ValidatorSetState())
+	resQ := target.Query(abci.RequestQuery{Path: "/key", Data: []byte("k4")})
+	assert.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+
+	// the restored node continues the chain like the original one, and
+	// accepts signed txs for the chain ID in the snapshot
+	tx := signTx(t, priv, "test-chain", 0, setTx([]byte("k5"), []byte("v")))
+	res := deliverBlock(target, tx)
+	require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+	assert.EqualValues(t, 5, target.Info(abci.RequestInfo{}).LastBlockHeight)
+
+	// a non-empty node refuses snapshots
+	resO := target.OfferSnapshot(abci.RequestOfferSnapshot{Snapshot: snapshot, AppHash: appHash})
+	assert.Equal(t, abci.ResponseOfferSnapshot_ABORT, resO.Result)
+}
+
+func TestExportImport(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	priv := ed25519.GenPrivKey()
+	pubKey, err := cryptoenc.PubKeyToProto(priv.PubKey())
+	require.NoError(t, err)
+	app.InitChain(abci.RequestInitChain{
+		ChainId:    "test-chain",
+		Validators: []abci.ValidatorUpdate{{PubKey: pubKey, Power: 1}},
+	})
+	res := deliverBlock(app, setTx([]byte("k1"), []byte("v1")))
+	require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+	oldHash := app.Info(abci.RequestInfo{}).LastBlockAppHash
+	res = deliverBlock(app,
+		setTx([]byte("k2"), []byte("v2")),
+		signTx(t, priv, "test-chain", 0, setTx([]byte("k3"), []byte("v3"))))
+	for _, r := range res {
+		require.Equal(t, abci.CodeTypeOK, r.Code, r.Log)
+	}
+	info := app.Info(abci.RequestInfo{})
+
+	for _, format := range []string{merkleeyes.ExportFormatJSON, merkleeyes.ExportFormatBinary} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, app.Export(&buf, 0, format))
+
+			dir := t.TempDir()
+			target, err := merkleeyes.New(dir, 0)
+			require.NoError(t, err)
+			require.NoError(t, target.Import(bytes.NewReader(buf.Bytes()), format))
+			target.CloseDB()
+
+			// the imported state is persisted
+			target, err = merkleeyes.New(dir, 0)
+			require.NoError(t, err)
+			defer target.CloseDB()
+			assert.Equal(t, info, target.Info(abci.RequestInfo{}))
+			assert.Equal(t, app.ValidatorSetState(), target.ValidatorSetState())
+			resQ := target.Query(abci.RequestQuery{Path: "/key", Data: []byte("k2")})
+			assert.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+			assert.Equal(t, []byte("v2"), resQ.Value)
+
+			// receipts and sequences are imported, too
+			resQ = target.Query(abci.RequestQuery{Path: "/account", Data: priv.PubKey().Bytes()})
+			require.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+			assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 1}, resQ.Value)
+			resD := target.DeliverTx(abci.RequestDeliverTx{Tx: setTx([]byte("k1"), []byte("v1"))})
+			assert.Equal(t, abci.CodeTypeOK, resD.Code, resD.Log)
+
+			// a non-empty state can't be replaced
+			assert.Error(t, target.Import(bytes.NewReader(buf.Bytes()), format))
+		})
+	}
+
+	// the JSON export has readable keys, receipts and validators
+	var buf bytes.Buffer
+	require.NoError(t, app.Export(&buf, 0, merkleeyes.ExportFormatJSON))
+	var decoded struct {
+		Keys []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"keys"`
+		Receipts []struct {
+			Nonce   string              `json:"nonce"`
+			Receipt *merkleeyes.Receipt `json:"receipt"`
+		} `json:"receipts"`
+		Validators *merkleeyes.ValidatorSetState `json:"validators"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Len(t, decoded.Keys, 3)
+	assert.Equal(t, []byte("k2"), decoded.Keys[1].Key)
+	assert.Equal(t, []byte("v2"), decoded.Keys[1].Value)
+	assert.Len(t, decoded.Receipts, 3)
+	for _, r := range decoded.Receipts {
+		require.NotNil(t, r.Receipt)
+		assert.Equal(t, abci.CodeTypeOK, r.Receipt.Code)
+	}
+	assert.Equal(t, app.ValidatorSetState(), decoded.Validators)
+
+	// an older height can be exported
+	buf.Reset()
+	require.NoError(t, app.Export(&buf, 1, merkleeyes.ExportFormatBinary))
+	target, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer target.CloseDB()
+	require.NoError(t, target.Import(&buf, merkleeyes.ExportFormatBinary))
+	assert.EqualValues(t, 1, target.Info(abci.RequestInfo{}).LastBlockHeight)
+	assert.Equal(t, oldHash, target.Info(abci.RequestInfo{}).LastBlockAppHash)
+
+	// an app hash mismatch fails the import and leaves the state empty
+	buf.Reset()
+	require.NoError(t, app.Export(&buf, 0, merkleeyes.ExportFormatJSON))
+	var export map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &export))
+	export["app_hash"] = "00"
+	bz, err := json.Marshal(export)
+	require.NoError(t, err)
+	target, err = merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer target.CloseDB()
+	assert.Error(t, target.Import(bytes.NewReader(bz), merkleeyes.ExportFormatJSON))
+	assert.EqualValues(t, 0, target.Info(abci.RequestInfo{}).LastBlockHeight)
+
+	assert.Error(t, app.Export(&buf, 5, merkleeyes.ExportFormatJSON))
+	assert.Error(t, app.Export(&buf, 0, "xml"))
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	app, err := merkleeyes.New(dir, 0)
+	require.NoError(t, err)
+	app.InitChain(abci.RequestInitChain{ChainId: "test-chain"})
+	res := deliverBlock(app, setTx([]byte("foo"), []byte("bar")))
+	require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+	info := app.Info(abci.RequestInfo{})
+	var want bytes.Buffer
+	require.NoError(t, app.Export(&want, 0, merkleeyes.ExportFormatBinary))
+	app.CloseDB()
+
+	// files returns the contents of all files in dir
+	files := func() map[string][]byte {
+		contents := make(map[string][]byte)
+		err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			contents[path], err = ioutil.ReadFile(path)
+			return err
+		})
+		require.NoError(t, err)
+		return contents
+	}
+	before := files()
+
+	app, err = merkleeyes.OpenReadOnly(dir, 0)
+	require.NoError(t, err)
+	assert.Equal(t, info, app.Info(abci.RequestInfo{}))
+	var got bytes.Buffer
+	require.NoError(t, app.Export(&got, 0, merkleeyes.ExportFormatBinary))
+	assert.Equal(t, want.Bytes(), got.Bytes())
+	app.CloseDB()
+
+	// the database wasn't written to
+	assert.Equal(t, before, files())
+
+	_, err = merkleeyes.OpenReadOnly(t.TempDir(), 0)
+	assert.Error(t, err)
+}
+
+func TestTxn(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: setTx([]byte("x"), []byte("1"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+
+	ops := [][]byte{
+		txnOp(merkleeyes.TxnOpRead, []byte("x")),
+		txnOp(merkleeyes.TxnOpWrite, []byte("x"), []byte("2")),
+		txnOp(merkleeyes.TxnOpAppend, []byte("l"), []byte("a")),
+		txnOp(merkleeyes.TxnOpAppend, []byte("l"), []byte("b")),
+		txnOp(merkleeyes.TxnOpRead, []byte("x")),
+		txnOp(merkleeyes.TxnOpRead, []byte("l")),
+		txnOp(merkleeyes.TxnOpDelete, []byte("x")),
+		txnOp(merkleeyes.TxnOpRead, []byte("x")),
+	}
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: txnTx(ops...)})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	reads := decodeList(t, res.Data)
+	require.Len(t, reads, 4)
+	assert.Equal(t, []byte("1"), reads[0])
+	assert.Equal(t, []byte("2"), reads[1])
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, decodeList(t, reads[2]))
+	assert.Empty(t, reads[3])
+
+	// a malformed op aborts the whole txn
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: txnTx(
+		txnOp(merkleeyes.TxnOpWrite, []byte("y"), []byte("1")),
+		[]byte{0xFF},
+	)})
+	assert.EqualValues(t, merkleeyes.CodeTypeEncodingError, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: readTx([]byte("y"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, res.Code, res.Log)
+
+	// appending to a value which isn't a list aborts the whole txn, also if
+	// the value was written by the txn itself
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: setTx([]byte("p"), []byte("bar"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	for _, ops := range [][][]byte{
+		{
+			txnOp(merkleeyes.TxnOpWrite, []byte("y"), []byte("1")),
+			txnOp(merkleeyes.TxnOpAppend, []byte("p"), []byte("a")),
+		},
+		{
+			txnOp(merkleeyes.TxnOpWrite, []byte("y"), []byte("1")),
+			txnOp(merkleeyes.TxnOpAppend, []byte("y"), []byte("a")),
+		},
+	} {
+		res = app.DeliverTx(abci.RequestDeliverTx{Tx: txnTx(ops...)})
+		assert.EqualValues(t, merkleeyes.CodeTypeErrWrongType, res.Code, res.Log)
+		res = app.DeliverTx(abci.RequestDeliverTx{Tx: readTx([]byte("y"))})
+		assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, res.Code, res.Log)
+	}
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: readTx([]byte("p"))})
+	assert.Equal(t, []byte("bar"), res.Data)
+
+	// a deleted value is an empty list again
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: txnTx(
+		txnOp(merkleeyes.TxnOpDelete, []byte("p")),
+		txnOp(merkleeyes.TxnOpAppend, []byte("p"), []byte("a")),
+	)})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: listReadTx([]byte("p"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, [][]byte{[]byte("a")}, decodeList(t, res.Data))
+}
+
+func TestAppend(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: listReadTx([]byte("l"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Empty(t, res.Data)
+
+	for _, e := range []string{"1", "2", "3"} {
+		res = app.DeliverTx(abci.RequestDeliverTx{Tx: appendTx([]byte("l"), []byte(e))})
+		require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	}
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: listReadTx([]byte("l"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, [][]byte{[]byte("1"), []byte("2"), []byte("3")}, decodeList(t, res.Data))
+
+	// not a list
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: setTx([]byte("foo"), []byte("bar"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: appendTx([]byte("foo"), []byte("1"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrWrongType, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: listReadTx([]byte("foo"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrWrongType, res.Code, res.Log)
+}
+
+func TestCounter(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: counterTx(merkleeyes.TxTypeIncrement, []byte("c"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, encodeUint64(1), res.Data)
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: counterTx(merkleeyes.TxTypeFetchAndAdd, []byte("c"), encodeUint64(41))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, encodeUint64(42), res.Data)
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: counterTx(merkleeyes.TxTypeDecrement, []byte("c"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, encodeUint64(41), res.Data)
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: counterTx(merkleeyes.TxTypeFetchAndAdd, []byte("c"), encodeUint64(math.MaxInt64))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrOverflow, res.Code, res.Log)
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: readTx([]byte("c"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, encodeUint64(41), res.Data)
+}
+
+func TestCompareAndSetFamily(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	// insert
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeInsert, []byte("foo"), []byte("bar"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeInsert, []byte("foo"), []byte("baz"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrUnauthorized, res.Code, res.Log)
+
+	// get and set
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeGetAndSet, []byte("foo"), []byte("qux"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, []byte("bar"), res.Data)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeGetAndSet, []byte("new"), []byte("1"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Empty(t, res.Data)
+
+	// compare and remove
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeCompareAndRm, []byte("foo"), []byte("bar"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrUnauthorized, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeCompareAndRm, []byte("foo"), []byte("qux"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeCompareAndRm, []byte("foo"), []byte("qux"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, res.Code, res.Log)
+}
+
+func TestCondTxn(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: setTx([]byte("a"), []byte("1"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+
+	guards := concat(
+		txnOp(merkleeyes.GuardValueEquals, []byte("a"), []byte("1")),
+		txnOp(merkleeyes.GuardMissing, []byte("b")),
+	)
+	thenOps := concat(
+		txnOp(merkleeyes.TxnOpWrite, []byte("b"), []byte("2")),
+		txnOp(merkleeyes.TxnOpRead, []byte("a")),
+	)
+	elseOps := txnOp(merkleeyes.TxnOpRead, []byte("b"))
+
+	// guards hold
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeCondTxn, guards, thenOps, elseOps)})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	require.NotEmpty(t, res.Data)
+	assert.Equal(t, merkleeyes.CondTxnThen, res.Data[0])
+	assert.Equal(t, [][]byte{[]byte("1")}, decodeList(t, res.Data[1:]))
+
+	// b exists now
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeCondTxn, guards, thenOps, elseOps)})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	require.NotEmpty(t, res.Data)
+	assert.Equal(t, merkleeyes.CondTxnElse, res.Data[0])
+	assert.Equal(t, [][]byte{[]byte("2")}, decodeList(t, res.Data[1:]))
+
+	// empty else branch
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeCondTxn, guards, thenOps, nil)})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, []byte{merkleeyes.CondTxnElse}, res.Data)
+}
+
+func TestTransfer(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: counterTx(merkleeyes.TxTypeFetchAndAdd, []byte("a"), encodeUint64(10))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: transferTx([]byte("a"), []byte("b"), 7)})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: transferTx([]byte("a"), []byte("b"), 4)})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrInsufficientFunds, res.Code, res.Log)
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeReadBalances, []byte("a"), []byte("b"), []byte("c"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, concat(encodeUint64(3), encodeUint64(7), encodeUint64(0)), res.Data)
+}
+
+func TestSet(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	for _, e := range []string{"3", "1", "2", "1"} {
+		res := app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeSetAdd, []byte("s"), []byte(e))})
+		require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	}
+
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeSetRead, []byte("s"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, [][]byte{[]byte("1"), []byte("2"), []byte("3")}, decodeList(t, res.Data))
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeSetRead, []byte("missing"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Empty(t, res.Data)
+}
+
+func TestExpiry(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	genesis := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	block := func(height int64, txs ...[]byte) []abci.ResponseDeliverTx {
+		app.BeginBlock(abci.RequestBeginBlock{Header: tmproto.Header{
+			Height: height,
+			Time:   genesis.Add(time.Duration(height) * time.Second),
+		}})
+		var res []abci.ResponseDeliverTx
+		for _, tx := range txs {
+			res = append(res, app.DeliverTx(abci.RequestDeliverTx{Tx: tx}))
+		}
+		app.EndBlock(abci.RequestEndBlock{Height: height})
+		app.Commit()
+		return res
+	}
+
+	heightExpiry := concat([]byte{merkleeyes.ExpiryHeight}, encodeUint64(3))
+	timeExpiry := concat([]byte{merkleeyes.ExpiryTime}, encodeUint64(uint64(genesis.Add(4*time.Second).UnixNano())))
+	pastExpiry := concat([]byte{merkleeyes.ExpiryHeight}, encodeUint64(1))
+
+	res := block(1,
+		concat(newTx(merkleeyes.TxTypeSetExpiring, []byte("a"), []byte("1")), heightExpiry),
+		concat(newTx(merkleeyes.TxTypeSetExpiring, []byte("b"), []byte("1")), timeExpiry),
+		concat(newTx(merkleeyes.TxTypeSetExpiring, []byte("c"), []byte("1")), heightExpiry),
+		concat(newTx(merkleeyes.TxTypeSetExpiring, []byte("d"), []byte("1")), pastExpiry),
+	)
+	for _, r := range res[:3] {
+		require.Equal(t, abci.CodeTypeOK, r.Code, r.Log)
+	}
+	assert.EqualValues(t, merkleeyes.CodeTypeErrExpiryPassed, res[3].Code, res[3].Log)
+
+	// a plain set clears the expiry of c
+	res = block(2, setTx([]byte("c"), []byte("2")))
+	require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+
+	query := func(key string) uint32 {
+		return app.Query(abci.RequestQuery{Path: "/key", Data: []byte(key)}).Code
+	}
+	assert.Equal(t, abci.CodeTypeOK, query("a"))
+	assert.Equal(t, abci.CodeTypeOK, query("b"))
+
+	res = block(3, readTx([]byte("a")), readTx([]byte("b")))
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, res[0].Code, res[0].Log)
+	assert.Equal(t, abci.CodeTypeOK, res[1].Code, res[1].Log)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, query("a"))
+
+	res = block(4, readTx([]byte("b")), readTx([]byte("c")))
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, res[0].Code, res[0].Log)
+	assert.Equal(t, abci.CodeTypeOK, res[1].Code, res[1].Log)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, query("b"))
+	assert.Equal(t, abci.CodeTypeOK, query("c"))
+}
+
+func TestRmRange(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	for _, k := range []string{"a1", "a2", "a3", "b1", "b2", "c1"} {
+		res := app.DeliverTx(abci.RequestDeliverTx{Tx: setTx([]byte(k), []byte("v"))})
+		require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	}
+
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeRmRange, []byte("a2"), []byte("b2"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, encodeUint64(3), res.Data)
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeRmPrefix, []byte("b"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, encodeUint64(1), res.Data)
+	app.EndBlock(abci.RequestEndBlock{})
+	app.Commit()
+
+	for k, code := range map[string]uint32{
+		"a1": abci.CodeTypeOK,
+		"a2": merkleeyes.CodeTypeErrBaseUnknownAddress,
+		"b1": merkleeyes.CodeTypeErrBaseUnknownAddress,
+		"b2": merkleeyes.CodeTypeErrBaseUnknownAddress,
+		"c1": abci.CodeTypeOK,
+	} {
+		resQ := app.Query(abci.RequestQuery{Path: "/key", Data: []byte(k)})
+		assert.Equal(t, code, resQ.Code, k)
+	}
+
+	// unbounded range
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeRmRange, nil, nil)})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, encodeUint64(2), res.Data)
+}
+
+func TestKeyMeta(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	setIfVersionTx := func(key []byte, version uint64, value []byte) []byte {
+		nonce := make([]byte, merkleeyes.NonceLength)
+		rand.Read(nonce)
+		return concat(nonce, []byte{merkleeyes.TxTypeSetIfVersion}, encodeBytes(key), encodeUint64(version), encodeBytes(value))
+	}
+
+	// height 1: create
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: setIfVersionTx([]byte("foo"), 0, []byte("1"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: setIfVersionTx([]byte("foo"), 0, []byte("1"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrUnauthorized, res.Code, res.Log)
+	app.EndBlock(abci.RequestEndBlock{})
+	app.Commit()
+
+	// height 2: update
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: setIfVersionTx([]byte("foo"), 2, []byte("2"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrUnauthorized, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: setIfVersionTx([]byte("foo"), 1, []byte("2"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: setIfVersionTx([]byte("bar"), 1, []byte("2"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, res.Code, res.Log)
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: readTx([]byte("foo"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	require.Len(t, res.Events, 1)
+	attrs := map[string]string{}
+	for _, a := range res.Events[0].Attributes {
+		attrs[string(a.Key)] = string(a.Value)
+	}
+	assert.Equal(t, map[string]string{"create_height": "1", "mod_height": "2", "version": "2"}, attrs)
+	app.EndBlock(abci.RequestEndBlock{})
+	app.Commit()
+
+	resQ := app.Query(abci.RequestQuery{Path: "/key", Data: []byte("foo")})
+	require.Equal(t, abci.CodeTypeOK, resQ.Code, resQ.Log)
+	var meta merkleeyes.KeyMeta
+	require.NoError(t, json.Unmarshal([]byte(resQ.Info), &meta))
+	assert.Equal(t, merkleeyes.KeyMeta{CreateHeight: 1, ModHeight: 2, Version: 2}, meta)
+}
+
+func TestQueue(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	app.BeginBlock(abci.RequestBeginBlock{})
+	res := app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeDequeue, []byte("q"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrQueueEmpty, res.Code, res.Log)
+
+	for _, e := range []string{"1", "2", "3"} {
+		res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeEnqueue, []byte("q"), []byte(e))})
+		require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	}
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeDequeue, []byte("q"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, []byte("1"), res.Data)
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeDrain, []byte("q"))})
+	require.Equal(t, abci.CodeTypeOK, res.Code, res.Log)
+	assert.Equal(t, [][]byte{[]byte("2"), []byte("3")}, decodeList(t, res.Data))
+
+	res = app.DeliverTx(abci.RequestDeliverTx{Tx: newTx(merkleeyes.TxTypeDequeue, []byte("q"))})
+	assert.EqualValues(t, merkleeyes.CodeTypeErrQueueEmpty, res.Code, res.Log)
+}
+
+func TestLock(t *testing.T) {
+	app, err := merkleeyes.New(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer app.CloseDB()
+
+	lockTx := func(typ byte, owner string, args ...uint64) []byte {
+		tx := newTx(typ, []byte("l"), []byte(owner))
+		for _, a := range args {
+			tx = append(tx, encodeUint64(a)...)
+		}
+		return tx
+	}
+	block := func(txs ...[]byte) []abci.ResponseDeliverTx { return deliverBlock(app, txs...) }
+
+	// height 1
+	res := block(
+		lockTx(merkleeyes.TxTypeLockAcquire, "a", 2),
+		lockTx(merkleeyes.TxTypeLockAcquire, "b", 2),
+		lockTx(merkleeyes.TxTypeLockRenew, "b", 1, 2),
+	)
+	require.Equal(t, abci.CodeTypeOK, res[0].Code, res[0].Log)
+	assert.Equal(t, encodeUint64(1), res[0].Data)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrLockHeld, res[1].Code, res[1].Log)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrUnauthorized, res[2].Code, res[2].Log)
+
+	// height 2: a's lease is still valid
+	res = block(lockTx(merkleeyes.TxTypeLockAcquire, "b", 2))
+	assert.EqualValues(t, merkleeyes.CodeTypeErrLockHeld, res[0].Code, res[0].Log)
+
+	// height 3: a's lease has lapsed
+	res = block(
+		lockTx(merkleeyes.TxTypeLockRenew, "a", 1, 2),
+		lockTx(merkleeyes.TxTypeLockAcquire, "b", 2),
+		lockTx(merkleeyes.TxTypeLockRelease, "b", 2),
+		lockTx(merkleeyes.TxTypeLockAcquire, "a", 2),
+	)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrBaseUnknownAddress, res[0].Code, res[0].Log)
+	require.Equal(t, abci.CodeTypeOK, res[1].Code, res[1].Log)
+	assert.Equal(t, encodeUint64(2), res[1].Data)
+	require.Equal(t, abci.CodeTypeOK, res[2].Code, res[2].Log)
+	require.Equal(t, abci.CodeTypeOK, res[3].Code, res[3].Log)
+	assert.Equal(t, encodeUint64(3), res[3].Data)
+
+	// height 4: leases overflowing the expiry height are rejected
+	res = block(
+		lockTx(merkleeyes.TxTypeLockRenew, "a", 3, math.MaxInt64),
+		lockTx(merkleeyes.TxTypeLockAcquire, "b", 2),
+		lockTx(merkleeyes.TxTypeLockRelease, "a", 3),
+		lockTx(merkleeyes.TxTypeLockAcquire, "b", math.MaxInt64),
+		lockTx(merkleeyes.TxTypeLockAcquire, "c", 2),
+		lockTx(merkleeyes.TxTypeLockAcquire, "b", 2),
+	)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrOverflow, res[0].Code, res[0].Log)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrLockHeld, res[1].Code, res[1].Log)
+	require.Equal(t, abci.CodeTypeOK, res[2].Code, res[2].Log)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrOverflow, res[3].Code, res[3].Log)
+	require.Equal(t, abci.CodeTypeOK, res[4].Code, res[4].Log)
+	assert.Equal(t, encodeUint64(4), res[4].Data)
+	assert.EqualValues(t, merkleeyes.CodeTypeErrLockHeld, res[5].Code, res[5].Log)
+}
+
+// deliverBlock executes and commits a block with the given txs.
+func deliverBlock(app *merkleeyes.App, txs ...[]byte) []abci.ResponseDeliverTx {
+	app.BeginBlock(abci.RequestBeginBlock{})
+	var res []abci.ResponseDeliverTx
+	for _, tx := range txs {
+		res = append(res, app.DeliverTx(abci.RequestDeliverTx{Tx: tx}))
+	}
+	app.EndBlock(abci.RequestEndBlock{})
+	app.Commit()
+	return res
+}
+
+// signTx wraps inner in a signed tx with the same nonce.
+func signTx(t *testing.T, priv crypto.PrivKey, chainID string, seq int64, inner []byte) []byte {
+	nonce, payload := inner[:merkleeyes.NonceLength], inner[merkleeyes.NonceLength:]
+	sig, err := priv.Sign(merkleeyes.SignBytes(chainID, nonce, seq, payload))
+	require.NoError(t, err)
+
+	tx := append(append([]byte{}, nonce...), merkleeyes.TxTypeSigned)
+	tx = append(tx, encodeBytes(priv.PubKey().Bytes())...)
+	tx = append(tx, encodeUint64(uint64(seq))...)
+	tx = append(tx, encodeBytes(sig)...)
+	return append(tx, payload...)
+}
+
 func readTx(key []byte) []byte {
 	nonce := make([]byte, merkleeyes.NonceLength)
 	rand.Read(nonce)
@@ -156,6 +1486,78 @@ func valsetCasTx(version uint64, pubKey crypto.PubKey, power int64) []byte {
 	return append(append(append(append(nonce, merkleeyes.TxTypeValSetCAS), versionBz...), pkBz...), powerBz...)
 }
 
+// newTx returns a transaction of the given type with each argument encoded
+// with encodeBytes.
+func newTx(typ byte, args ...[]byte) []byte {
+	nonce := make([]byte, merkleeyes.NonceLength)
+	rand.Read(nonce)
+
+	tx := append(nonce, typ)
+	for _, a := range args {
+		tx = append(tx, encodeBytes(a)...)
+	}
+	return tx
+}
+
+func appendTx(key, elem []byte) []byte {
+	nonce := make([]byte, merkleeyes.NonceLength)
+	rand.Read(nonce)
+
+	return append(append(append(nonce, merkleeyes.TxTypeAppend), encodeBytes(key)...), encodeBytes(elem)...)
+}
+
+func listReadTx(key []byte) []byte {
+	nonce := make([]byte, merkleeyes.NonceLength)
+	rand.Read(nonce)
+
+	return append(append(nonce, merkleeyes.TxTypeListRead), encodeBytes(key)...)
+}
+
+func counterTx(typ byte, key []byte, delta ...[]byte) []byte {
+	nonce := make([]byte, merkleeyes.NonceLength)
+	rand.Read(nonce)
+
+	tx := append(append(nonce, typ), encodeBytes(key)...)
+	for _, d := range delta {
+		tx = append(tx, d...)
+	}
+	return tx
+}
+
+func transferTx(from, to []byte, amount uint64) []byte {
+	nonce := make([]byte, merkleeyes.NonceLength)
+	rand.Read(nonce)
+
+	return concat(nonce, []byte{merkleeyes.TxTypeTransfer}, encodeBytes(from), encodeBytes(to), encodeUint64(amount))
+}
+
+func txnTx(ops ...[]byte) []byte {
+	nonce := make([]byte, merkleeyes.NonceLength)
+	rand.Read(nonce)
+
+	tx := append(nonce, merkleeyes.TxTypeTxn)
+	for _, op := range ops {
+		tx = append(tx, op...)
+	}
+	return tx
+}
+
+func txnOp(typ byte, args ...[]byte) []byte {
+	op := []byte{typ}
+	for _, a := range args {
+		op = append(op, encodeBytes(a)...)
+	}
+	return op
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
 func encodeBytes(b []byte) []byte {
 	// length prefix
 	lenBz := make([]byte, binary.MaxVarintLen64)
@@ -169,3 +1571,33 @@ func encodeUint64(i uint64) []byte {
 	binary.BigEndian.PutUint64(b, i)
 	return b
 }
+
+func encodeUvarint(i uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, i)
+	return b[:n]
+}
+
+// decodeList decodes Encode(item1) | Encode(item2) | ...
+func decodeList(t *testing.T, bz []byte) [][]byte {
+	var items [][]byte
+	for len(bz) > 0 {
+		length, n := binary.Uvarint(bz)
+		require.Greater(t, n, 0)
+		require.GreaterOrEqual(t, len(bz), n+int(length))
+		items = append(items, bz[n:n+int(length)])
+		bz = bz[n+int(length):]
+	}
+	return items
+}
+
+// decodePairs decodes Encode(key1) | Encode(value1) | ...
+func decodePairs(t *testing.T, bz []byte) [][2][]byte {
+	var pairs [][2][]byte
+	items := decodeList(t, bz)
+	require.True(t, len(items)%2 == 0)
+	for i := 0; i < len(items); i += 2 {
+		pairs = append(pairs, [2][]byte{items[i], items[i+1]})
+	}
+	return pairs
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	merkleeyes "github.com/melekes/jepsen/merkleeyes"
+	abci "github.com/tendermint/tendermint/abci/types"
+)
+
+// runExport implements "merkleeyes export", which writes the state at a
+// height to a file (or stdout).
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbDir := fs.String("dbdir", "", "database directory")
+	height := fs.Int64("height", 0, "height to export (0 = latest)")
+	format := fs.String("format", merkleeyes.ExportFormatJSON, "export format: json or binary")
+	out := fs.String("out", "", "output file (default stdout)")
+	_ = fs.Parse(args)
+
+	// the database is opened read-only, so exporting doesn't change it
+	app, err := merkleeyes.OpenReadOnly(*dbDir, 0)
+	if err != nil {
+		return fmt.Errorf("can't open database: %w", err)
+	}
+	defer app.CloseDB()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("can't create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := app.Export(bw, *height, *format); err != nil {
+		return fmt.Errorf("can't export state: %w", err)
+	}
+	return bw.Flush()
+}
+
+// runImport implements "merkleeyes import", which creates a database from
+// an export read from a file (or stdin).
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dbDir := fs.String("dbdir", "", "database directory (must be empty)")
+	format := fs.String("format", merkleeyes.ExportFormatJSON, "export format: json or binary")
+	in := fs.String("in", "", "input file (default stdin)")
+	_ = fs.Parse(args)
+
+	app, err := merkleeyes.New(*dbDir, 0)
+	if err != nil {
+		return fmt.Errorf("can't create app: %w", err)
+	}
+	defer app.CloseDB()
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return fmt.Errorf("can't open input file: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if err := app.Import(r, *format); err != nil {
+		return fmt.Errorf("can't import state: %w", err)
+	}
+	info := app.Info(abci.RequestInfo{})
+	fmt.Fprintf(os.Stderr, "imported height %d, app hash %X\n", info.LastBlockHeight, info.LastBlockAppHash)
+	return nil
+}
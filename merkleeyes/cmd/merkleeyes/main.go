@@ -14,19 +14,70 @@ import (
 var (
 	logger = log.NewTMLogger(log.NewSyncWriter(os.Stdout))
 
-	dbDir string
-	laddr string
+	dbDir       string
+	laddr       string
+	nonceWindow int64
+	chainID     string
+
+	pruning           string
+	pruningKeepRecent int64
+	pruningKeepEvery  int64
+
+	snapshotInterval   int64
+	snapshotKeepRecent int
 )
 
 func init() {
 	flag.StringVar(&dbDir, "dbdir", "", "database directory")
 	flag.StringVar(&laddr, "laddr", "unix://data.sock", "listen address")
+	flag.Int64Var(&nonceWindow, "nonce-window", 0,
+		"number of blocks in which a tx is valid after the height in its nonce (0 = forever)")
+	flag.StringVar(&chainID, "chain-id", "",
+		"chain ID of a database created before chain IDs were stored (set by InitChain otherwise)")
+	flag.StringVar(&pruning, "pruning", merkleeyes.PruningNothing,
+		"pruning strategy: nothing (keep all heights), everything (keep the latest height only) or custom")
+	flag.Int64Var(&pruningKeepRecent, "pruning-keep-recent", 0,
+		"number of latest heights to keep (custom pruning only)")
+	flag.Int64Var(&pruningKeepEvery, "pruning-keep-every", 0,
+		"keep every n-th height besides the latest ones (custom pruning only, 0 = none)")
+	flag.Int64Var(&snapshotInterval, "snapshot-interval", 0,
+		"take a state sync snapshot every n heights (0 = never)")
+	flag.IntVar(&snapshotKeepRecent, "snapshot-keep-recent", 2,
+		"number of latest snapshots to keep (0 = all)")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		var run func([]string) error
+		switch os.Args[1] {
+		case "export":
+			run = runExport
+		case "import":
+			run = runImport
+		}
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v", os.Args[1], err)
+				os.Exit(3)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 
-	app, err := merkleeyes.New(dbDir, 0)
+	pruningOpts, err := merkleeyes.NewPruningOptions(pruning, pruningKeepRecent, pruningKeepEvery)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid pruning options: %v", err)
+		os.Exit(3)
+	}
+
+	app, err := merkleeyes.New(dbDir, 0,
+		merkleeyes.WithNonceWindow(nonceWindow),
+		merkleeyes.WithChainID(chainID),
+		merkleeyes.WithPruning(pruningOpts),
+		merkleeyes.WithSnapshots(snapshotInterval, snapshotKeepRecent),
+	)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "can't create app: %v", err)
 		os.Exit(3) // 1 and 2 are reserved (https://tldp.org/LDP/abs/html/exitcodes.html)
@@ -0,0 +1,95 @@
+package merkleeyes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/cosmos/iavl"
+	abci "github.com/tendermint/tendermint/abci/types"
+)
+
+// Counters (and account balances) are stored as big-endian signed 64-bit
+// integers. A missing key is a zero counter.
+
+// getCounter returns the counter stored under key.
+func getCounter(tree *iavl.MutableTree, key []byte) (int64, abci.ResponseDeliverTx) {
+	_, bz := tree.Get(storeKey(key))
+	if bz == nil {
+		return 0, abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+	}
+	if len(bz) != 8 {
+		return 0, abci.ResponseDeliverTx{
+			Code: CodeTypeErrWrongType,
+			Log:  fmt.Sprintf("Value of %X is not a counter: %X", key, bz),
+		}
+	}
+	return int64(binary.BigEndian.Uint64(bz)), abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+}
+
+// addToCounter adds delta to the counter stored under key and returns the new
+// value. Adding fails with CodeTypeErrOverflow, leaving the counter intact, if
+// the result doesn't fit into an int64.
+func addToCounter(tree *iavl.MutableTree, key []byte, delta int64) (int64, abci.ResponseDeliverTx) {
+	value, res := getCounter(tree, key)
+	if res.Code != abci.CodeTypeOK {
+		return 0, res
+	}
+
+	if addOverflows(value, delta) {
+		return 0, abci.ResponseDeliverTx{
+			Code: CodeTypeErrOverflow,
+			Log:  fmt.Sprintf("Adding %d to %d overflows", delta, value),
+		}
+	}
+	value += delta
+
+	setKey(tree, key, encodeInt64(value))
+
+	return value, abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: encodeInt64(value)}
+}
+
+// transfer atomically moves amount from one counter to another. It fails with
+// CodeTypeErrInsufficientFunds if the balance of from is less than amount.
+func transfer(tree *iavl.MutableTree, from, to []byte, amount int64) abci.ResponseDeliverTx {
+	fromBalance, res := getCounter(tree, from)
+	if res.Code != abci.CodeTypeOK {
+		return res
+	}
+	toBalance, res := getCounter(tree, to)
+	if res.Code != abci.CodeTypeOK {
+		return res
+	}
+
+	if fromBalance < amount {
+		return abci.ResponseDeliverTx{
+			Code: CodeTypeErrInsufficientFunds,
+			Log:  fmt.Sprintf("Balance of %X is %d, can't transfer %d", from, fromBalance, amount),
+		}
+	}
+	if bytes.Equal(from, to) {
+		return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+	}
+	if addOverflows(toBalance, amount) {
+		return abci.ResponseDeliverTx{
+			Code: CodeTypeErrOverflow,
+			Log:  fmt.Sprintf("Adding %d to %d overflows", amount, toBalance),
+		}
+	}
+
+	setKey(tree, from, encodeInt64(fromBalance-amount))
+	setKey(tree, to, encodeInt64(toBalance+amount))
+
+	return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+}
+
+func addOverflows(value, delta int64) bool {
+	return (delta > 0 && value > math.MaxInt64-delta) || (delta < 0 && value < math.MinInt64-delta)
+}
+
+func encodeInt64(i int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	return b
+}
@@ -0,0 +1,128 @@
+package merkleeyes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/cosmos/iavl"
+)
+
+// Expiry kinds.
+const (
+	// ExpiryHeight expires a key at the given block height.
+	ExpiryHeight byte = 0x01
+	// ExpiryTime expires a key at the given block time (Unix nanoseconds).
+	ExpiryTime byte = 0x02
+)
+
+// expiryLength is the length of an encoded expiry: kind byte + int64.
+const expiryLength = 9
+
+// expiry is the point at which a key expires. An expired key is removed at
+// the beginning of the first block whose height (or header time) is greater
+// than or equal to at.
+type expiry struct {
+	kind byte
+	at   int64
+}
+
+func (e expiry) String() string {
+	if e.kind == ExpiryHeight {
+		return fmt.Sprintf("height %d", e.at)
+	}
+	return fmt.Sprintf("time %v", time.Unix(0, e.at).UTC())
+}
+
+func decodeExpiry(bz []byte) (expiry, error) {
+	if len(bz) != expiryLength {
+		return expiry{}, fmt.Errorf("expiry must be %d bytes, got %d", expiryLength, len(bz))
+	}
+
+	e := expiry{kind: bz[0], at: int64(binary.BigEndian.Uint64(bz[1:]))}
+	if e.kind != ExpiryHeight && e.kind != ExpiryTime {
+		return expiry{}, fmt.Errorf("unexpected expiry kind %X", e.kind)
+	}
+	if e.at <= 0 {
+		return expiry{}, fmt.Errorf("expiry must be positive, got %d", e.at)
+	}
+	return e, nil
+}
+
+func (e expiry) bytes() []byte {
+	return append([]byte{e.kind}, encodeInt64(e.at)...)
+}
+
+// passed returns true if a key with this expiry must not be visible in a block
+// with the given height and time.
+func (e expiry) passed(height int64, blockTime time.Time) bool {
+	if e.kind == ExpiryHeight {
+		return e.at <= height
+	}
+	return !blockTime.IsZero() && e.at <= blockTime.UnixNano()
+}
+
+// ttlKey maps a key to its expiry.
+func ttlKey(key []byte) []byte {
+	return append([]byte("/ttl/"), key...)
+}
+
+// expiryIndexKey orders keys by their expiry, so expired keys can be found
+// without scanning the whole tree.
+func expiryIndexKey(e expiry, key []byte) []byte {
+	return append(expiryIndexPrefix(e.kind, e.at), key...)
+}
+
+func expiryIndexPrefix(kind byte, at int64) []byte {
+	return append(append([]byte("/expiry/"), kind), encodeInt64(at)...)
+}
+
+// setExpiry makes key expire at e, replacing any previous expiry.
+func setExpiry(tree *iavl.MutableTree, key []byte, e expiry) {
+	clearExpiry(tree, key)
+	_ = tree.Set(ttlKey(key), e.bytes())
+	_ = tree.Set(expiryIndexKey(e, key), []byte{0x01})
+}
+
+// clearExpiry removes the expiry of key, if any.
+func clearExpiry(tree *iavl.MutableTree, key []byte) {
+	_, bz := tree.Get(ttlKey(key))
+	if bz == nil {
+		return
+	}
+	e, err := decodeExpiry(bz)
+	if err != nil {
+		panic(fmt.Sprintf("corrupted expiry of %X: %v", key, err))
+	}
+	_, _ = tree.Remove(ttlKey(key))
+	_, _ = tree.Remove(expiryIndexKey(e, key))
+}
+
+// expireKeys removes all keys which expire at or before the given height and
+// block time, and returns them. Keys are removed in index order, so every node
+// ends up with the same tree.
+func expireKeys(tree *iavl.MutableTree, height int64, blockTime time.Time) [][]byte {
+	expired := expiredKeys(tree, ExpiryHeight, height)
+	if !blockTime.IsZero() {
+		expired = append(expired, expiredKeys(tree, ExpiryTime, blockTime.UnixNano())...)
+	}
+
+	for _, key := range expired {
+		_ = removeKey(tree, key)
+	}
+	return expired
+}
+
+// expiredKeys returns the keys of the given expiry kind which expire at or
+// before limit.
+func expiredKeys(tree *iavl.MutableTree, kind byte, limit int64) [][]byte {
+	var keys [][]byte
+
+	start, end := expiryIndexPrefix(kind, 0), expiryIndexPrefix(kind, limit+1)
+	tree.IterateRange(start, end, true, func(indexKey, _ []byte) bool {
+		keys = append(keys, append([]byte{}, indexKey[len(start):]...))
+		return false
+	})
+
+	return keys
+}
@@ -0,0 +1,195 @@
+package merkleeyes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl"
+	tmbytes "github.com/tendermint/tendermint/libs/bytes"
+)
+
+// Export formats.
+const (
+	// ExportFormatJSON is a single JSON document, which is read into memory as
+	// a whole when imported.
+	ExportFormatJSON = "json"
+	// ExportFormatBinary is Encode(AppHash) | Payload, where Payload is the
+	// state payload also used by snapshots. It is read as a stream.
+	ExportFormatBinary = "binary"
+)
+
+// jsonExport is the JSON export of a state. Keys, Receipts and Validators are
+// decoded from the tree for readers; only Nodes are imported.
+type jsonExport struct {
+	AppHash    tmbytes.HexBytes   `json:"app_hash"`
+	State      auxState           `json:"state"`
+	Keys       []jsonKey          `json:"keys"`
+	Receipts   []jsonReceipt      `json:"receipts"`
+	Validators *ValidatorSetState `json:"validators"`
+	Nodes      []jsonNode         `json:"nodes"`
+}
+
+// jsonKey is a (user) key/value pair.
+type jsonKey struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// jsonReceipt is a used nonce and its receipt. Receipt is null for nonces
+// stored by older versions, which didn't record receipts.
+type jsonReceipt struct {
+	Nonce   tmbytes.HexBytes `json:"nonce"`
+	Receipt *Receipt         `json:"receipt"`
+}
+
+// jsonNode is a tree node as returned by iavl's exporter. Value is null for
+// inner nodes.
+type jsonNode struct {
+	Height  int8   `json:"height"`
+	Version int64  `json:"version"`
+	Key     []byte `json:"key"`
+	Value   []byte `json:"value"`
+}
+
+// Export writes the state at height (0 = latest) to w in the given format.
+// The export contains the whole tree, i.e. keys, receipts, accounts, the
+// validator set etc., as well as the height and the chain ID.
+func (app *App) Export(w io.Writer, height int64, format string) error {
+	tree, err := app.state.CommittedAt(height)
+	if err != nil {
+		return err
+	}
+	if height == 0 {
+		height = app.state.Height
+	}
+	aux := auxState{Height: height, ChainID: app.state.ChainID}
+
+	switch format {
+	case ExportFormatJSON:
+		export, err := decodeExport(tree)
+		if err != nil {
+			return err
+		}
+		export.AppHash, export.State = tree.Hash(), aux
+		err = exportNodes(tree, func(node *iavl.ExportNode) error {
+			export.Nodes = append(export.Nodes, jsonNode{
+				Height:  node.Height,
+				Version: node.Version,
+				Key:     node.Key,
+				Value:   node.Value,
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(export)
+
+	case ExportFormatBinary:
+		if _, err := w.Write(encodeBytes(tree.Hash())); err != nil {
+			return err
+		}
+		return writePayload(w, aux, tree)
+
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// decodeExport returns a JSON export with the keys, receipts and validators
+// of tree, but without nodes.
+func decodeExport(tree *iavl.ImmutableTree) (jsonExport, error) {
+	export := jsonExport{
+		Keys:     []jsonKey{},
+		Receipts: []jsonReceipt{},
+		Nodes:    []jsonNode{},
+	}
+
+	prefixRange(nil).iterate(tree, false, func(key, value []byte) bool {
+		export.Keys = append(export.Keys, jsonKey{
+			Key:   append([]byte{}, key...),
+			Value: append([]byte{}, value...),
+		})
+		return false
+	})
+
+	var err error
+	prefix := nonceKey(nil)
+	tree.IterateRange(prefix, prefixEnd(prefix), true, func(key, value []byte) bool {
+		r := jsonReceipt{Nonce: append([]byte{}, key[len(prefix):]...)}
+		if len(value) != len(legacyNonceMarker) || value[0] != legacyNonceMarker[0] {
+			if r.Receipt, err = decodeReceipt(value); err != nil {
+				err = fmt.Errorf("receipt of %X: %w", r.Nonce, err)
+				return true
+			}
+		}
+		export.Receipts = append(export.Receipts, r)
+		return false
+	})
+	if err != nil {
+		return export, err
+	}
+
+	export.Validators, _ = loadValidatorSet(tree)
+	return export, nil
+}
+
+// Import replaces the (empty) state with the one read from r in the given
+// format and checks that it has the exported app hash. If that fails, the
+// state is empty again.
+func (app *App) Import(r io.Reader, format string) error {
+	if format != ExportFormatJSON && format != ExportFormatBinary {
+		return fmt.Errorf("unknown export format %q", format)
+	}
+	if app.state.Height != 0 {
+		return fmt.Errorf("state isn't empty (height %d)", app.state.Height)
+	}
+
+	return app.restoreState(func(tree *iavl.MutableTree) error {
+		var (
+			appHash []byte
+			aux     auxState
+			err     error
+		)
+		switch format {
+		case ExportFormatJSON:
+			var export jsonExport
+			if err := json.NewDecoder(r).Decode(&export); err != nil {
+				return fmt.Errorf("decode export: %w", err)
+			}
+			appHash, aux = export.AppHash, export.State
+			nodes := export.Nodes
+			err = importNodes(tree, treeVersion(aux.Height), func() (*iavl.ExportNode, error) {
+				if len(nodes) == 0 {
+					return nil, io.EOF
+				}
+				node := nodes[0]
+				nodes = nodes[1:]
+				return &iavl.ExportNode{
+					Height:  node.Height,
+					Version: node.Version,
+					Key:     node.Key,
+					Value:   node.Value,
+				}, nil
+			})
+
+		case ExportFormatBinary:
+			br := bufio.NewReader(r)
+			if appHash, err = readBytes(br); err != nil {
+				return fmt.Errorf("read app hash: %w", err)
+			}
+			aux, err = importPayload(br, tree)
+		}
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(tree.Hash(), appHash) {
+			return fmt.Errorf("imported app hash %X, expected %X", tree.Hash(), appHash)
+		}
+		return saveAuxState(app.db, tree.Version(), aux)
+	})
+}
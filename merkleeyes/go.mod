@@ -5,6 +5,7 @@ go 1.15
 require (
 	github.com/cosmos/iavl v0.15.0
 	github.com/stretchr/testify v1.6.1
+	github.com/syndtr/goleveldb v1.0.1-0.20200815110645-5c35d600f0ca
 	github.com/tendermint/tendermint v0.34.1-dev1
 	github.com/tendermint/tm-db v0.6.3
 )
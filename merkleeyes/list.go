@@ -0,0 +1,94 @@
+package merkleeyes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Lists are stored as the concatenation of their encoded elements:
+//
+//	Encode(Elem1) | Encode(Elem2) | ...
+//
+// An empty or missing value is an empty list. Sets are stored as lists whose
+// elements are unique and sorted in ascending byte order.
+
+// appendElement returns list with elem appended.
+func appendElement(list, elem []byte) []byte {
+	return append(append([]byte{}, list...), encodeBytes(elem)...)
+}
+
+// decodeList decodes an encoded list.
+func decodeList(list []byte) ([][]byte, error) {
+	var elems [][]byte
+	for len(list) > 0 {
+		elem, n, err := decodeBytes(list)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", len(elems), err)
+		}
+		elems = append(elems, elem)
+		list = list[n:]
+	}
+	return elems, nil
+}
+
+// decodeSet decodes an encoded set, checking that it's in canonical order.
+func decodeSet(set []byte) ([][]byte, error) {
+	elems, err := decodeList(set)
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(elems); i++ {
+		if bytes.Compare(elems[i-1], elems[i]) >= 0 {
+			return nil, errors.New("elements are not unique and sorted")
+		}
+	}
+	return elems, nil
+}
+
+// addToSet returns set with elem added, and whether it was not a member of
+// set before.
+func addToSet(set, elem []byte) ([]byte, bool, error) {
+	elems, err := decodeSet(set)
+	if err != nil {
+		return nil, false, err
+	}
+
+	i := sort.Search(len(elems), func(i int) bool { return bytes.Compare(elems[i], elem) >= 0 })
+	if i < len(elems) && bytes.Equal(elems[i], elem) {
+		return set, false, nil
+	}
+
+	var newSet []byte
+	for _, e := range elems[:i] {
+		newSet = append(newSet, encodeBytes(e)...)
+	}
+	newSet = append(newSet, encodeBytes(elem)...)
+	for _, e := range elems[i:] {
+		newSet = append(newSet, encodeBytes(e)...)
+	}
+	return newSet, true, nil
+}
+
+// removeFromSet returns set with elem removed, and whether it was a member of
+// set before.
+func removeFromSet(set, elem []byte) ([]byte, bool, error) {
+	elems, err := decodeSet(set)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var (
+		newSet  []byte
+		removed bool
+	)
+	for _, e := range elems {
+		if bytes.Equal(e, elem) {
+			removed = true
+			continue
+		}
+		newSet = append(newSet, encodeBytes(e)...)
+	}
+	return newSet, removed, nil
+}
@@ -0,0 +1,117 @@
+package merkleeyes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cosmos/iavl"
+	abci "github.com/tendermint/tendermint/abci/types"
+)
+
+// lock is a lease on a named lock. The lease lapses at height expires, i.e.
+// the lock is held in blocks below that height.
+type lock struct {
+	owner   []byte
+	token   int64
+	expires int64
+}
+
+// lockKey maps a lock name to the current lock.
+func lockKey(name []byte) []byte {
+	return append([]byte("/lock/"), name...)
+}
+
+// lockTokenKey maps a lock name to the last fencing token issued for it. It's
+// kept after the lock is released, so tokens increase monotonically.
+func lockTokenKey(name []byte) []byte {
+	return append([]byte("/lock-token/"), name...)
+}
+
+// getLock returns the lock if it's held at the given height, or nil.
+func getLock(tree *iavl.MutableTree, name []byte, height int64) *lock {
+	_, bz := tree.Get(lockKey(name))
+	if bz == nil {
+		return nil
+	}
+
+	owner, n, err := decodeBytes(bz)
+	if err != nil || len(bz) != n+16 {
+		panic(fmt.Sprintf("corrupted lock %X: %X", name, bz))
+	}
+	l := &lock{
+		owner:   owner,
+		token:   int64(binary.BigEndian.Uint64(bz[n : n+8])),
+		expires: int64(binary.BigEndian.Uint64(bz[n+8:])),
+	}
+	if l.expires <= height {
+		return nil
+	}
+	return l
+}
+
+func setLock(tree *iavl.MutableTree, name []byte, l *lock) {
+	bz := append(encodeBytes(l.owner), encodeInt64(l.token)...)
+	_ = tree.Set(lockKey(name), append(bz, encodeInt64(l.expires)...))
+}
+
+// acquireLock acquires the lock for owner for lease blocks, unless it's held
+// already. It returns the new fencing token.
+func acquireLock(tree *iavl.MutableTree, name, owner []byte, lease int64) (int64, abci.ResponseDeliverTx) {
+	height := workingHeight(tree)
+	if l := getLock(tree, name, height); l != nil {
+		return 0, abci.ResponseDeliverTx{
+			Code: CodeTypeErrLockHeld,
+			Log:  fmt.Sprintf("Lock %X is held by %X until height %d", name, l.owner, l.expires),
+		}
+	}
+
+	var token int64
+	if _, bz := tree.Get(lockTokenKey(name)); bz != nil {
+		token = int64(binary.BigEndian.Uint64(bz))
+	}
+	token++
+	_ = tree.Set(lockTokenKey(name), encodeInt64(token))
+
+	setLock(tree, name, &lock{owner: owner, token: token, expires: height + lease})
+	return token, abci.ResponseDeliverTx{Code: abci.CodeTypeOK, Data: encodeInt64(token)}
+}
+
+// checkLockHolder returns the lock if it's held by owner with the given token.
+func checkLockHolder(tree *iavl.MutableTree, name, owner []byte, token int64) (*lock, abci.ResponseDeliverTx) {
+	l := getLock(tree, name, workingHeight(tree))
+	if l == nil {
+		return nil, abci.ResponseDeliverTx{
+			Code: CodeTypeErrBaseUnknownAddress,
+			Log:  fmt.Sprintf("Lock %X is not held", name),
+		}
+	}
+	if !bytes.Equal(l.owner, owner) || l.token != token {
+		return nil, abci.ResponseDeliverTx{
+			Code: CodeTypeErrUnauthorized,
+			Log:  fmt.Sprintf("Lock %X is held by %X with token %d", name, l.owner, l.token),
+		}
+	}
+	return l, abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+}
+
+// renewLock extends the lease of a held lock to lease blocks from now.
+func renewLock(tree *iavl.MutableTree, name, owner []byte, token, lease int64) abci.ResponseDeliverTx {
+	l, res := checkLockHolder(tree, name, owner, token)
+	if l == nil {
+		return res
+	}
+	l.expires = workingHeight(tree) + lease
+	setLock(tree, name, l)
+	return res
+}
+
+// releaseLock releases a held lock.
+func releaseLock(tree *iavl.MutableTree, name, owner []byte, token int64) abci.ResponseDeliverTx {
+	l, res := checkLockHolder(tree, name, owner, token)
+	if l == nil {
+		return res
+	}
+	_, _ = tree.Remove(lockKey(name))
+	return res
+}
@@ -0,0 +1,74 @@
+package merkleeyes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/cosmos/iavl"
+	abci "github.com/tendermint/tendermint/abci/types"
+)
+
+// KeyMeta is the revision metadata of a key.
+type KeyMeta struct {
+	// CreateHeight is the height at which the key was created.
+	CreateHeight int64 `json:"create_height"`
+	// ModHeight is the height at which the key was last written.
+	ModHeight int64 `json:"mod_height"`
+	// Version is the number of times the key was written since it was created.
+	Version int64 `json:"version"`
+}
+
+// metaLength is the length of encoded KeyMeta.
+const metaLength = 24
+
+func metaKey(key []byte) []byte {
+	return append([]byte("/meta/"), key...)
+}
+
+// getMeta returns the metadata of key. Keys written before metadata was
+// introduced have zero metadata.
+func getMeta(tree *iavl.ImmutableTree, key []byte) KeyMeta {
+	_, bz := tree.Get(metaKey(key))
+	if bz == nil {
+		return KeyMeta{}
+	}
+	if len(bz) != metaLength {
+		panic(fmt.Sprintf("corrupted metadata of %X: %X", key, bz))
+	}
+	return KeyMeta{
+		CreateHeight: int64(binary.BigEndian.Uint64(bz[0:8])),
+		ModHeight:    int64(binary.BigEndian.Uint64(bz[8:16])),
+		Version:      int64(binary.BigEndian.Uint64(bz[16:24])),
+	}
+}
+
+// touchMeta records a write of key at the current height.
+func touchMeta(tree *iavl.MutableTree, key []byte) {
+	height := workingHeight(tree)
+
+	meta := KeyMeta{CreateHeight: height, ModHeight: height, Version: 1}
+	if tree.Has(storeKey(key)) {
+		meta = getMeta(tree.ImmutableTree, key)
+		meta.ModHeight = height
+		meta.Version++
+	}
+
+	bz := make([]byte, 0, metaLength)
+	bz = append(bz, encodeInt64(meta.CreateHeight)...)
+	bz = append(bz, encodeInt64(meta.ModHeight)...)
+	bz = append(bz, encodeInt64(meta.Version)...)
+	_ = tree.Set(metaKey(key), bz)
+}
+
+// event returns the metadata as an ABCI event.
+func (m KeyMeta) event() abci.Event {
+	return abci.Event{
+		Type: "key",
+		Attributes: []abci.EventAttribute{
+			{Key: []byte("create_height"), Value: []byte(strconv.FormatInt(m.CreateHeight, 10))},
+			{Key: []byte("mod_height"), Value: []byte(strconv.FormatInt(m.ModHeight, 10))},
+			{Key: []byte("version"), Value: []byte(strconv.FormatInt(m.Version, 10))},
+		},
+	}
+}
@@ -0,0 +1,46 @@
+package merkleeyes
+
+// Option configures an App.
+type Option func(*App)
+
+// WithNonceWindow bounds the validity of nonces to a window of blocks, so that
+// nonces (and the receipts stored under them) can be pruned. With a window,
+// a nonce must start with a height (8 bytes big-endian), and the transaction
+// is only valid in blocks Height+1 to Height+heights. Its nonce is pruned at
+// the beginning of the first block in which it's no longer valid. Zero (the
+// default) retains nonces forever and puts no constraints on them.
+//
+// All nodes must use the same window, since pruning changes the app hash.
+func WithNonceWindow(heights int64) Option {
+	return func(app *App) {
+		app.nonceWindow = heights
+	}
+}
+
+// WithChainID sets the chain ID of a database created before chain IDs were
+// stored, for which InitChain isn't called again. Signed transactions are
+// signed over the chain ID, so until it's set they must be signed with an
+// empty one. The chain ID is saved right away; opening a database whose chain
+// ID differs fails.
+func WithChainID(chainID string) Option {
+	return func(app *App) {
+		app.chainID = chainID
+	}
+}
+
+// WithPruning sets which heights are kept. By default, all heights are kept.
+func WithPruning(o PruningOptions) Option {
+	return func(app *App) {
+		app.state.Pruning = o
+	}
+}
+
+// WithSnapshots makes the app take a state-sync snapshot every interval
+// blocks and keep the keepRecent latest ones (0 = all). Snapshots are stored
+// in the snapshots directory next to the database.
+func WithSnapshots(interval int64, keepRecent int) Option {
+	return func(app *App) {
+		app.snapshotInterval = interval
+		app.snapshotKeepRecent = keepRecent
+	}
+}
@@ -0,0 +1,168 @@
+package merkleeyes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl"
+)
+
+const (
+	// payloadFormat is the version of the state payload encoding.
+	payloadFormat byte = 0x01
+
+	// maxPayloadBytesLen is the maximum length of a byte array in a payload.
+	maxPayloadBytesLen = 1 << 30
+)
+
+// The state payload is the binary encoding of a committed state, which is
+// used by snapshots:
+//
+//	Format (1 byte) | Encode(AuxState) | Node1 | Node2 | ...
+//
+// where AuxState is JSON and each tree node, in the order of iavl's exporter,
+// is encoded as:
+//
+//	Height (1 byte) | Version (int64) | Encode(Key) [| Encode(Value)]
+//
+// Only leaf nodes (height 0) have a value. Importing the nodes restores the
+// tree with the same hash.
+
+// writePayload writes the payload of tree, whose auxiliary state is s, to w.
+func writePayload(w io.Writer, s auxState, tree *iavl.ImmutableTree) error {
+	bw := bufio.NewWriter(w)
+
+	auxBz, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	if _, err := bw.Write(append([]byte{payloadFormat}, encodeBytes(auxBz)...)); err != nil {
+		return err
+	}
+
+	err = exportNodes(tree, func(node *iavl.ExportNode) error {
+		bz := append([]byte{byte(node.Height)}, encodeInt64(node.Version)...)
+		bz = append(bz, encodeBytes(node.Key)...)
+		if node.Height == 0 {
+			bz = append(bz, encodeBytes(node.Value)...)
+		}
+		_, err := bw.Write(bz)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// importPayload imports the payload read from r into tree, which must be
+// empty, and returns the auxiliary state.
+func importPayload(r io.Reader, tree *iavl.MutableTree) (auxState, error) {
+	var s auxState
+	br := bufio.NewReader(r)
+
+	format, err := br.ReadByte()
+	if err != nil {
+		return s, fmt.Errorf("read format: %w", err)
+	}
+	if format != payloadFormat {
+		return s, fmt.Errorf("unknown payload format %X", format)
+	}
+	auxBz, err := readBytes(br)
+	if err != nil {
+		return s, fmt.Errorf("read state: %w", err)
+	}
+	if err := json.Unmarshal(auxBz, &s); err != nil {
+		return s, fmt.Errorf("unmarshal state: %w", err)
+	}
+
+	err = importNodes(tree, treeVersion(s.Height), func() (*iavl.ExportNode, error) {
+		height, err := br.ReadByte()
+		if err != nil {
+			return nil, err // io.EOF ends the import
+		}
+
+		node := &iavl.ExportNode{Height: int8(height)}
+		var versionBz [8]byte
+		if _, err := io.ReadFull(br, versionBz[:]); err != nil {
+			return nil, fmt.Errorf("read node version: %w", err)
+		}
+		node.Version = int64(binary.BigEndian.Uint64(versionBz[:]))
+		if node.Key, err = readBytes(br); err != nil {
+			return nil, fmt.Errorf("read node key: %w", err)
+		}
+		if node.Height == 0 {
+			if node.Value, err = readBytes(br); err != nil {
+				return nil, fmt.Errorf("read node value: %w", err)
+			}
+		}
+		return node, nil
+	})
+	return s, err
+}
+
+// exportNodes calls fn for every node of tree, in the order of iavl's
+// exporter.
+func exportNodes(tree *iavl.ImmutableTree, fn func(*iavl.ExportNode) error) error {
+	exporter := tree.Export()
+	defer exporter.Close()
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, iavl.ExportDone) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("export tree: %w", err)
+		}
+		if err := fn(node); err != nil {
+			return err
+		}
+	}
+}
+
+// importNodes imports the nodes returned by next into tree, which must be
+// empty, as the given version. next returns io.EOF after the last node.
+func importNodes(tree *iavl.MutableTree, version int64, next func() (*iavl.ExportNode, error)) error {
+	importer, err := tree.Import(version)
+	if err != nil {
+		return fmt.Errorf("import tree: %w", err)
+	}
+	defer importer.Close()
+
+	for {
+		node, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := importer.Add(node); err != nil {
+			return fmt.Errorf("import node: %w", err)
+		}
+	}
+
+	if err := importer.Commit(); err != nil {
+		return fmt.Errorf("commit import: %w", err)
+	}
+	return nil
+}
+
+// readBytes reads an encoded byte array from r.
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxPayloadBytesLen {
+		return nil, fmt.Errorf("length %d exceeds %d", length, maxPayloadBytesLen)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
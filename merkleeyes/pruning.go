@@ -0,0 +1,71 @@
+package merkleeyes
+
+import (
+	"fmt"
+
+	"github.com/cosmos/iavl"
+)
+
+// Pruning strategies.
+const (
+	// PruningNothing keeps all heights.
+	PruningNothing = "nothing"
+	// PruningEverything keeps only the latest height.
+	PruningEverything = "everything"
+	// PruningCustom keeps the KeepRecent latest heights and every KeepEvery-th
+	// height.
+	PruningCustom = "custom"
+)
+
+// PruningOptions define which heights (tree versions) are kept after Commit.
+// The KeepRecent latest heights are always kept; older heights are kept only
+// if they're a multiple of KeepEvery. KeepRecent = 0 keeps all heights.
+type PruningOptions struct {
+	KeepRecent int64
+	KeepEvery  int64
+}
+
+// NewPruningOptions returns the options of the given strategy. keepRecent and
+// keepEvery are only used by PruningCustom.
+func NewPruningOptions(strategy string, keepRecent, keepEvery int64) (PruningOptions, error) {
+	switch strategy {
+	case PruningNothing:
+		return PruningOptions{}, nil
+	case PruningEverything:
+		return PruningOptions{KeepRecent: 1}, nil
+	case PruningCustom:
+		if keepRecent < 1 {
+			return PruningOptions{}, fmt.Errorf("keep-recent must be at least 1, got %d", keepRecent)
+		}
+		if keepEvery < 0 {
+			return PruningOptions{}, fmt.Errorf("keep-every must not be negative, got %d", keepEvery)
+		}
+		return PruningOptions{KeepRecent: keepRecent, KeepEvery: keepEvery}, nil
+	default:
+		return PruningOptions{}, fmt.Errorf("unknown pruning strategy %q", strategy)
+	}
+}
+
+// keeps returns true if height must be kept once latest is committed.
+func (o PruningOptions) keeps(height, latest int64) bool {
+	if o.KeepRecent == 0 || height > latest-o.KeepRecent {
+		return true
+	}
+	return o.KeepEvery > 0 && height%o.KeepEvery == 0
+}
+
+// prune deletes the tree versions of all heights which aren't kept once height
+// is committed. Since all available versions are checked, heights which were
+// kept under earlier options (e.g. before a restart) are collected too.
+func prune(tree *iavl.MutableTree, o PruningOptions, height int64) error {
+	var versions []int64
+	for _, v := range tree.AvailableVersions() {
+		if h := int64(v) - 1; !o.keeps(h, height) {
+			versions = append(versions, int64(v))
+		}
+	}
+	if err := tree.DeleteVersions(versions...); err != nil {
+		return fmt.Errorf("delete versions %v: %w", versions, err)
+	}
+	return nil
+}
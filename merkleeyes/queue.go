@@ -0,0 +1,73 @@
+package merkleeyes
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cosmos/iavl"
+)
+
+// A queue is stored as a pair of sequence numbers, the head (the sequence
+// number of the oldest element) and the tail (the sequence number of the next
+// enqueued element), plus one entry per element, ordered by sequence number.
+// The queue is empty if head equals tail.
+
+// queueKey maps a queue name to its head and tail.
+func queueKey(name []byte) []byte {
+	return append([]byte("/queue/"), encodeBytes(name)...)
+}
+
+// queueItemKey maps a queue name and a sequence number to an element.
+func queueItemKey(name []byte, seq int64) []byte {
+	return append(append([]byte("/queue-item/"), encodeBytes(name)...), encodeInt64(seq)...)
+}
+
+func getQueue(tree *iavl.MutableTree, name []byte) (head, tail int64) {
+	_, bz := tree.Get(queueKey(name))
+	if bz == nil {
+		return 0, 0
+	}
+	if len(bz) != 16 {
+		panic(fmt.Sprintf("corrupted queue %X: %X", name, bz))
+	}
+	return int64(binary.BigEndian.Uint64(bz[:8])), int64(binary.BigEndian.Uint64(bz[8:]))
+}
+
+func setQueue(tree *iavl.MutableTree, name []byte, head, tail int64) {
+	if head == tail {
+		_, _ = tree.Remove(queueKey(name))
+		return
+	}
+	_ = tree.Set(queueKey(name), append(encodeInt64(head), encodeInt64(tail)...))
+}
+
+// enqueue adds elem to the end of the queue.
+func enqueue(tree *iavl.MutableTree, name, elem []byte) {
+	head, tail := getQueue(tree, name)
+	_ = tree.Set(queueItemKey(name, tail), elem)
+	setQueue(tree, name, head, tail+1)
+}
+
+// dequeue removes and returns the head of the queue, or nil if the queue is
+// empty.
+func dequeue(tree *iavl.MutableTree, name []byte) []byte {
+	head, tail := getQueue(tree, name)
+	if head == tail {
+		return nil
+	}
+	elem, _ := tree.Remove(queueItemKey(name, head))
+	setQueue(tree, name, head+1, tail)
+	return elem
+}
+
+// drain removes and returns all elements of the queue, oldest first.
+func drain(tree *iavl.MutableTree, name []byte) [][]byte {
+	head, tail := getQueue(tree, name)
+	elems := make([][]byte, 0, tail-head)
+	for seq := head; seq < tail; seq++ {
+		elem, _ := tree.Remove(queueItemKey(name, seq))
+		elems = append(elems, elem)
+	}
+	setQueue(tree, name, tail, tail)
+	return elems
+}
@@ -0,0 +1,216 @@
+package merkleeyes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cosmos/iavl"
+)
+
+// maxRangeLimit is the maximum number of key/value pairs returned by a single
+// range or prefix query.
+const maxRangeLimit = 1000
+
+// keyRange is a range of (user) keys. Start is inclusive, end is exclusive. A
+// nil bound means the range is unbounded on that side.
+type keyRange struct {
+	start, end []byte
+}
+
+// prefixRange returns the range of keys starting with prefix.
+func prefixRange(prefix []byte) keyRange {
+	return keyRange{start: prefix, end: prefixEnd(prefix)}
+}
+
+// storeBounds returns the range bounds translated into the tree's key space.
+func (r keyRange) storeBounds() (start, end []byte) {
+	start = storeKey(r.start)
+	if r.end != nil {
+		end = storeKey(r.end)
+	} else {
+		end = prefixEnd(storeKey(nil))
+	}
+	return start, end
+}
+
+// iterate calls fn for every key/value pair in the range, in ascending (or
+// descending if reverse is true) order, until fn returns true. Keys passed to
+// fn do not include the store prefix.
+func (r keyRange) iterate(tree *iavl.ImmutableTree, reverse bool, fn func(key, value []byte) bool) {
+	start, end := r.storeBounds()
+	if bytes.Compare(start, end) >= 0 {
+		return
+	}
+	tree.IterateRange(start, end, !reverse, func(key, value []byte) bool {
+		return fn(key[len(storeKey(nil)):], value)
+	})
+}
+
+// keys returns all keys in the range, in ascending order.
+func (r keyRange) keys(tree *iavl.ImmutableTree) [][]byte {
+	var keys [][]byte
+	r.iterate(tree, false, func(key, _ []byte) bool {
+		keys = append(keys, append([]byte{}, key...))
+		return false
+	})
+	return keys
+}
+
+// removeRange removes all keys in the range and returns their number.
+func removeRange(tree *iavl.MutableTree, r keyRange) int {
+	keys := r.keys(tree.ImmutableTree)
+	for _, key := range keys {
+		_ = removeKey(tree, key)
+	}
+	return len(keys)
+}
+
+// rangeQuery is a paginated scan over a key range.
+type rangeQuery struct {
+	keyRange
+
+	// cursor is the last key returned by the previous page (if any). The scan
+	// resumes right after it.
+	cursor  []byte
+	reverse bool
+	limit   int
+}
+
+// decodeRangeQuery decodes "/range" query data:
+//
+//	Encode(start) | Encode(end) | Encode(cursor) | reverse (1 byte) | limit (uvarint)
+//
+// Empty start, end or cursor mean unset.
+func decodeRangeQuery(buf []byte) (rangeQuery, error) {
+	var q rangeQuery
+
+	start, n, err := decodeBytes(buf)
+	if err != nil {
+		return q, fmt.Errorf("start: %w", err)
+	}
+	buf = buf[n:]
+
+	end, n, err := decodeBytes(buf)
+	if err != nil {
+		return q, fmt.Errorf("end: %w", err)
+	}
+	buf = buf[n:]
+
+	if len(start) > 0 {
+		q.start = start
+	}
+	if len(end) > 0 {
+		q.end = end
+	}
+
+	return q, decodePage(&q, buf)
+}
+
+// decodePrefixQuery decodes "/prefix" query data:
+//
+//	Encode(prefix) | Encode(cursor) | reverse (1 byte) | limit (uvarint)
+//
+// An empty cursor means unset.
+func decodePrefixQuery(buf []byte) (rangeQuery, error) {
+	var q rangeQuery
+
+	prefix, n, err := decodeBytes(buf)
+	if err != nil {
+		return q, fmt.Errorf("prefix: %w", err)
+	}
+	q.keyRange = prefixRange(prefix)
+
+	return q, decodePage(&q, buf[n:])
+}
+
+// decodePage decodes the pagination arguments shared by range and prefix
+// queries.
+func decodePage(q *rangeQuery, buf []byte) error {
+	cursor, n, err := decodeBytes(buf)
+	if err != nil {
+		return fmt.Errorf("cursor: %w", err)
+	}
+	buf = buf[n:]
+	if len(cursor) > 0 {
+		q.cursor = cursor
+	}
+
+	if len(buf) < 1 {
+		return errors.New("reverse: not enough bytes")
+	}
+	switch buf[0] {
+	case 0x00:
+	case 0x01:
+		q.reverse = true
+	default:
+		return fmt.Errorf("reverse: invalid flag %X", buf[0])
+	}
+	buf = buf[1:]
+
+	limit, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return errors.New("limit: buf too small or value larger than 64bits")
+	}
+	if n != len(buf) {
+		return errors.New("got bytes left over")
+	}
+	if limit == 0 || limit > maxRangeLimit {
+		limit = maxRangeLimit
+	}
+	q.limit = int(limit)
+
+	return nil
+}
+
+// run executes the query against tree. It returns the encoded pairs, i.e.
+// Encode(key1) | Encode(value1) | Encode(key2) | ..., and a cursor for the
+// next page, which is nil if there are no more keys.
+func (q rangeQuery) run(tree *iavl.ImmutableTree) (pairs, cursor []byte) {
+	r := q.keyRange
+	if q.cursor != nil {
+		if q.reverse {
+			if r.end == nil || bytes.Compare(q.cursor, r.end) < 0 {
+				r.end = q.cursor
+			}
+		} else {
+			next := append(append([]byte{}, q.cursor...), 0x00)
+			if bytes.Compare(next, r.start) > 0 {
+				r.start = next
+			}
+		}
+	}
+
+	var (
+		count   int
+		lastKey []byte
+	)
+	r.iterate(tree, q.reverse, func(key, value []byte) bool {
+		if count == q.limit {
+			cursor = lastKey
+			return true
+		}
+		pairs = append(pairs, encodeBytes(key)...)
+		pairs = append(pairs, encodeBytes(value)...)
+		lastKey = key
+		count++
+		return false
+	})
+
+	return pairs, cursor
+}
+
+// prefixEnd returns the smallest key greater than all keys starting with
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for len(end) > 0 {
+		if end[len(end)-1] != 0xFF {
+			end[len(end)-1]++
+			return end
+		}
+		end = end[:len(end)-1]
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package merkleeyes
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cosmos/iavl"
+	abci "github.com/tendermint/tendermint/abci/types"
+)
+
+// Receipt is the outcome of an executed transaction. It's stored under the
+// transaction's nonce, so clients can learn the result of a transaction whose
+// broadcast timed out. A resubmitted transaction returns the same code, data
+// and events.
+type Receipt struct {
+	Code   uint32       `json:"code"`
+	Data   []byte       `json:"data"`
+	Events []abci.Event `json:"events,omitempty"`
+	Height int64        `json:"height"`
+}
+
+// legacyNonceMarker is what older versions stored under a nonce instead of a
+// receipt.
+var legacyNonceMarker = []byte{0x01}
+
+// getReceipt returns the receipt for the given nonce or nil if the nonce
+// wasn't used yet.
+func getReceipt(tree *iavl.ImmutableTree, nonce []byte) (*Receipt, error) {
+	_, bz := tree.Get(nonceKey(nonce))
+	if bz == nil {
+		return nil, nil
+	}
+	return decodeReceipt(bz)
+}
+
+func decodeReceipt(bz []byte) (*Receipt, error) {
+	if len(bz) == len(legacyNonceMarker) && bz[0] == legacyNonceMarker[0] {
+		return nil, errors.New("no receipt recorded")
+	}
+
+	var r Receipt
+	if err := json.Unmarshal(bz, &r); err != nil {
+		return nil, fmt.Errorf("unmarshal receipt: %w", err)
+	}
+	return &r, nil
+}
+
+func setReceipt(tree *iavl.MutableTree, nonce []byte, r *Receipt) {
+	bz, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	_ = tree.Set(nonceKey(nonce), bz)
+}
+
+// nonceHeight returns the height at the start of a nonce (see
+// WithNonceWindow).
+func nonceHeight(nonce []byte) int64 {
+	return int64(binary.BigEndian.Uint64(nonce[:8]))
+}
+
+// checkNonceHeight checks that a tx with the given nonce is valid in the
+// block at height, i.e. that the height of the nonce is at most window
+// heights behind.
+func checkNonceHeight(nonce []byte, height, window int64) error {
+	switch h := nonceHeight(nonce); {
+	case h < 0 || h >= height:
+		return fmt.Errorf("nonce height %d is not below %d", h, height)
+	case h < height-window:
+		return fmt.Errorf("nonce height %d is more than %d heights behind", h, window)
+	}
+	return nil
+}
+
+// nonceExpiryKey orders nonces by the height at which they're pruned, so
+// pruning doesn't need to scan all nonces.
+func nonceExpiryKey(height int64, nonce []byte) []byte {
+	return append(nonceExpiryPrefix(height), nonce...)
+}
+
+func nonceExpiryPrefix(height int64) []byte {
+	return append([]byte("/nonce-expiry/"), encodeInt64(height)...)
+}
+
+// setNonceExpiry makes nonce (and its receipt) be pruned at the given height.
+func setNonceExpiry(tree *iavl.MutableTree, nonce []byte, height int64) {
+	_ = tree.Set(nonceExpiryKey(height, nonce), []byte{0x01})
+}
+
+// pruneNonces removes all nonces which are pruned at or before the given
+// height, and returns their number. Nonces are removed in index order, so
+// every node ends up with the same tree.
+func pruneNonces(tree *iavl.MutableTree, height int64) int {
+	var indexKeys [][]byte
+	start, end := nonceExpiryPrefix(0), nonceExpiryPrefix(height+1)
+	tree.IterateRange(start, end, true, func(indexKey, _ []byte) bool {
+		indexKeys = append(indexKeys, append([]byte{}, indexKey...))
+		return false
+	})
+
+	for _, indexKey := range indexKeys {
+		_, _ = tree.Remove(nonceKey(indexKey[len(start):]))
+		_, _ = tree.Remove(indexKey)
+	}
+	return len(indexKeys)
+}
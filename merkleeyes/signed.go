@@ -0,0 +1,112 @@
+package merkleeyes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/cosmos/iavl"
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+)
+
+// signedTx is a TxTypeSigned envelope around another transaction.
+type signedTx struct {
+	pubKey   ed25519.PubKey
+	sequence int64
+	sig      []byte
+	payload  []byte // type byte and args of the wrapped tx
+}
+
+// decodeSignedTx decodes a signed transaction:
+//
+//	Encode(PubKey) | Sequence (int64) | Encode(Signature) | Payload
+//
+// where Payload is the type byte and the arguments of the wrapped transaction.
+func decodeSignedTx(tx []byte) (*signedTx, abci.ResponseDeliverTx) {
+	var st signedTx
+
+	pubKey, errResp, n := unmarshalBytes(tx, "pubkey", false)
+	if pubKey == nil {
+		return nil, errResp
+	}
+	if len(pubKey) != ed25519.PubKeySize {
+		return nil, abci.ResponseDeliverTx{
+			Code: CodeTypeEncodingError,
+			Log:  fmt.Sprintf("Pubkey must be %d bytes, got %d", ed25519.PubKeySize, len(pubKey)),
+		}
+	}
+	st.pubKey = ed25519.PubKey(pubKey)
+	tx = tx[n:]
+
+	if len(tx) < 8 {
+		return nil, abci.ResponseDeliverTx{Code: CodeTypeEncodingError, Log: "Sequence must be 8 bytes"}
+	}
+	st.sequence = int64(binary.BigEndian.Uint64(tx[:8]))
+	tx = tx[8:]
+
+	sig, errResp, n := unmarshalBytes(tx, "signature", false)
+	if sig == nil {
+		return nil, errResp
+	}
+	st.sig = sig
+	tx = tx[n:]
+
+	if len(tx) == 0 {
+		return nil, abci.ResponseDeliverTx{Code: CodeTypeEncodingError, Log: "Payload is empty"}
+	}
+	st.payload = tx
+
+	return &st, abci.ResponseDeliverTx{}
+}
+
+// SignBytes returns the bytes to sign for a signed transaction:
+//
+//	Encode(ChainID) | Nonce | Sequence (int64) | Payload
+func SignBytes(chainID string, nonce []byte, sequence int64, payload []byte) []byte {
+	bz := encodeBytes([]byte(chainID))
+	bz = append(bz, nonce...)
+	bz = append(bz, encodeInt64(sequence)...)
+	return append(bz, payload...)
+}
+
+// verify checks the signature of the transaction with the given nonce.
+func (st *signedTx) verify(chainID string, nonce []byte) abci.ResponseDeliverTx {
+	if !st.pubKey.VerifySignature(SignBytes(chainID, nonce, st.sequence, st.payload), st.sig) {
+		return abci.ResponseDeliverTx{
+			Code: CodeTypeErrBadSignature,
+			Log:  fmt.Sprintf("Invalid signature by %X", st.pubKey.Bytes()),
+		}
+	}
+	return abci.ResponseDeliverTx{Code: abci.CodeTypeOK}
+}
+
+// event returns the sender of the transaction as an ABCI event.
+func (st *signedTx) event() abci.Event {
+	return abci.Event{
+		Type: "tx",
+		Attributes: []abci.EventAttribute{
+			{Key: []byte("sender"), Value: []byte(fmt.Sprintf("%X", st.pubKey.Bytes()))},
+			{Key: []byte("sequence"), Value: []byte(strconv.FormatInt(st.sequence, 10))},
+		},
+	}
+}
+
+// accountKey maps an account's pubkey to its next sequence number.
+func accountKey(pubKey []byte) []byte {
+	return append([]byte("/account/"), pubKey...)
+}
+
+// getSequence returns the next sequence number of the account, which is zero
+// for an account which didn't send any transactions yet.
+func getSequence(tree *iavl.ImmutableTree, pubKey []byte) int64 {
+	_, bz := tree.Get(accountKey(pubKey))
+	if bz == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(bz))
+}
+
+func setSequence(tree *iavl.MutableTree, pubKey []byte, sequence int64) {
+	_ = tree.Set(accountKey(pubKey), encodeInt64(sequence))
+}
@@ -0,0 +1,222 @@
+package merkleeyes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	dbm "github.com/tendermint/tm-db"
+)
+
+const (
+	// snapshotFormat is the format of the snapshots, which consist of the
+	// state payload (see payload.go) split into chunks.
+	snapshotFormat = uint32(payloadFormat)
+
+	// snapshotChunkSize is the maximum size of a snapshot chunk.
+	snapshotChunkSize = 4 << 20
+)
+
+// snapshotStore keeps snapshots on disk: each snapshot in a directory named
+// after its height, with a file per chunk and the snapshot's metadata in
+// snapshot.json. The metadata of a snapshot is the concatenation of the
+// SHA-256 hashes of its chunks; its hash is the SHA-256 hash of the payload.
+type snapshotStore struct {
+	dir string
+	// number of snapshots to keep (0 = all)
+	keepRecent int
+}
+
+func newSnapshotStore(dir string, keepRecent int) (*snapshotStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create snapshot dir: %w", err)
+	}
+	return &snapshotStore{dir: dir, keepRecent: keepRecent}, nil
+}
+
+func (ss *snapshotStore) snapshotDir(height uint64) string {
+	return filepath.Join(ss.dir, strconv.FormatUint(height, 10))
+}
+
+// create writes a new snapshot at height, whose payload is written by write,
+// and removes snapshots which are no longer kept.
+func (ss *snapshotStore) create(height uint64, write func(w *chunkWriter) error) (*abci.Snapshot, error) {
+	dir := ss.snapshotDir(height)
+	// a previous attempt might have left an incomplete snapshot behind
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	w := &chunkWriter{dir: dir, payloadHash: sha256.New()}
+	if err := write(w); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	snapshot := &abci.Snapshot{
+		Height:   height,
+		Format:   snapshotFormat,
+		Chunks:   w.chunks,
+		Hash:     w.payloadHash.Sum(nil),
+		Metadata: w.chunkHashes,
+	}
+	bz, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	// the metadata is written last, so incomplete snapshots aren't listed
+	if err := ioutil.WriteFile(filepath.Join(dir, "snapshot.json"), bz, 0o644); err != nil {
+		return nil, err
+	}
+
+	return snapshot, ss.prune()
+}
+
+// list returns all complete snapshots, latest first.
+func (ss *snapshotStore) list() ([]*abci.Snapshot, error) {
+	entries, err := ioutil.ReadDir(ss.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*abci.Snapshot
+	for _, e := range entries {
+		bz, err := ioutil.ReadFile(filepath.Join(ss.dir, e.Name(), "snapshot.json"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var snapshot abci.Snapshot
+		if err := json.Unmarshal(bz, &snapshot); err != nil {
+			return nil, fmt.Errorf("unmarshal snapshot %s: %w", e.Name(), err)
+		}
+		snapshots = append(snapshots, &snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Height > snapshots[j].Height })
+	return snapshots, nil
+}
+
+// loadChunk returns the given chunk of the snapshot at height.
+func (ss *snapshotStore) loadChunk(height uint64, index uint32) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(ss.snapshotDir(height), strconv.FormatUint(uint64(index), 10)))
+}
+
+// prune removes all but the keepRecent latest snapshots.
+func (ss *snapshotStore) prune() error {
+	if ss.keepRecent <= 0 {
+		return nil
+	}
+	snapshots, err := ss.list()
+	if err != nil {
+		return err
+	}
+	for i := ss.keepRecent; i < len(snapshots); i++ {
+		if err := os.RemoveAll(ss.snapshotDir(snapshots[i].Height)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkWriter splits a payload into chunk files of at most snapshotChunkSize
+// bytes.
+type chunkWriter struct {
+	dir         string
+	chunks      uint32
+	chunk       []byte
+	chunkHashes []byte
+	payloadHash hash.Hash
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	_, _ = w.payloadHash.Write(p)
+	for len(p) > 0 {
+		free := snapshotChunkSize - len(w.chunk)
+		if free > len(p) {
+			free = len(p)
+		}
+		w.chunk = append(w.chunk, p[:free]...)
+		p = p[free:]
+		if len(w.chunk) == snapshotChunkSize {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last chunk.
+func (w *chunkWriter) Close() error {
+	if len(w.chunk) > 0 || w.chunks == 0 {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *chunkWriter) flush() error {
+	path := filepath.Join(w.dir, strconv.FormatUint(uint64(w.chunks), 10))
+	if err := ioutil.WriteFile(path, w.chunk, 0o644); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(w.chunk)
+	w.chunkHashes = append(w.chunkHashes, sum[:]...)
+	w.chunks++
+	w.chunk = w.chunk[:0]
+	return nil
+}
+
+// snapshotRestore is a snapshot being restored.
+type snapshotRestore struct {
+	snapshot *abci.Snapshot
+	appHash  []byte
+	// index of the next chunk
+	next    uint32
+	payload bytes.Buffer
+}
+
+// verifyChunk checks the chunk against its hash in the snapshot metadata.
+func (r *snapshotRestore) verifyChunk(index uint32, chunk []byte) bool {
+	sum := sha256.Sum256(chunk)
+	return bytes.Equal(sum[:], r.snapshot.Metadata[index*sha256.Size:(index+1)*sha256.Size])
+}
+
+// wipeDB deletes all keys from db.
+func wipeDB(db dbm.DB) error {
+	it, err := db.Iterator(nil, nil)
+	if err != nil {
+		return err
+	}
+	var keys [][]byte
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+
+	batch := db.NewBatch()
+	defer batch.Close()
+	for _, key := range keys {
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+	}
+	return batch.WriteSync()
+}
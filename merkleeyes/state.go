@@ -1,7 +1,9 @@
 package merkleeyes
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/cosmos/iavl"
@@ -9,22 +11,56 @@ import (
 	dbm "github.com/tendermint/tm-db"
 )
 
+// stateKey is where older versions stored the auxiliary state. It's migrated
+// to auxStateKey on startup.
 var stateKey = []byte("merkleeyes:state")
 
+// auxStatePrefix prefixes the auxiliary state of each tree version.
+var auxStatePrefix = []byte("merkleeyes:state/")
+
+var (
+	// ErrHeightNotCommitted is returned when a height above the last
+	// committed one is requested.
+	ErrHeightNotCommitted = errors.New("height is not committed yet")
+	// ErrHeightPruned is returned when the tree version for a height is no
+	// longer retained.
+	ErrHeightPruned = errors.New("height is pruned")
+	// ErrStateMismatch is returned by NewState when the stored auxiliary state
+	// doesn't match the latest tree version.
+	ErrStateMismatch = errors.New("auxiliary state doesn't match the tree")
+)
+
 // State represents the app states, separating the commited state (for queries)
-// from the working state (for CheckTx and DeliverTx).
+// from the working state (for DeliverTx) and the check state (for CheckTx).
 //
-// It contains the latest root hash and block height as well as the active validator set.
+// It contains the latest root hash and block height as well as the active validator set
+// and the chain ID.
 type State struct {
 	Working   *iavl.MutableTree
 	Committed *iavl.ImmutableTree
+	// Check is a copy of Committed, which CheckTx executes txs against. It's
+	// never saved.
+	Check *iavl.MutableTree
 
 	Height     int64              `json:"height"`
 	Validators *ValidatorSetState `json:"validators"`
+	ChainID    string             `json:"chain_id"`
+
+	// Pruning defines which heights are kept after Commit.
+	Pruning PruningOptions `json:"-"`
+
+	treeCacheSize int
 }
 
 // NewState returns a new State.
 func NewState(db dbm.DB, treeCacheSize int) (*State, error) {
+	return loadState(db, treeCacheSize, false)
+}
+
+// loadState loads the state from db. If readOnly is true, db isn't written to:
+// the auxiliary state isn't repaired, the validator set of older versions
+// isn't moved into the tree and an empty database is an error.
+func loadState(db dbm.DB, treeCacheSize int, readOnly bool) (*State, error) {
 	// Initialize a tree.
 	tree, err := iavl.NewMutableTree(db, treeCacheSize)
 	if err != nil {
@@ -36,6 +72,9 @@ func NewState(db dbm.DB, treeCacheSize int) (*State, error) {
 	}
 
 	// Get immutable version.
+	if lastVersion == 0 && readOnly {
+		return nil, errors.New("database is empty")
+	}
 	if lastVersion == 0 {
 		_, lastVersion, err = tree.SaveVersion()
 		if err != nil {
@@ -49,26 +88,86 @@ func NewState(db dbm.DB, treeCacheSize int) (*State, error) {
 	}
 
 	// Load the auxiliary state.
-	auxState, err := loadAuxState(db)
+	auxState, err := loadAuxState(db, lastVersion)
 	if err != nil {
 		return nil, fmt.Errorf("load additional state: %w", err)
 	}
+	if !readOnly {
+		if err := repairAuxState(db, lastVersion, auxState); err != nil {
+			return nil, fmt.Errorf("repair additional state: %w", err)
+		}
+	}
+
+	// Load the validator set. Older versions stored it in the auxiliary state,
+	// from which it's moved into the tree with the next commit.
+	validators, ok := loadValidatorSet(iTree)
+	if !ok && auxState.Validators != nil {
+		validators = auxState.Validators
+		if !readOnly && (len(validators.Validators) > 0 || validators.Version > 0) {
+			saveValidatorSet(tree, validators)
+			validators, _ = loadValidatorSet(tree.ImmutableTree)
+		}
+	}
 
 	return &State{
 		Working:   tree,
 		Committed: iTree,
 
+		treeCacheSize: treeCacheSize,
+
 		Height:     auxState.Height,
-		Validators: auxState.Validators,
+		Validators: validators,
+		ChainID:    auxState.ChainID,
 	}, nil
 }
 
+// SetChainID sets the chain ID of a state which has none yet, i.e. of a
+// database created before chain IDs were stored, and saves it right away. A
+// different chain ID than the stored one is an error.
+func (s *State) SetChainID(db dbm.DB, chainID string) error {
+	switch s.ChainID {
+	case chainID:
+		return nil
+	case "":
+	default:
+		return fmt.Errorf("chain ID is already %q", s.ChainID)
+	}
+
+	version := treeVersion(s.Height)
+	aux, err := loadAuxState(db, version)
+	if err != nil {
+		return fmt.Errorf("load additional state: %w", err)
+	}
+	aux.ChainID = chainID
+	if err := saveAuxState(db, version, aux); err != nil {
+		return err
+	}
+	s.ChainID = chainID
+	return nil
+}
+
 // Commit saves Working version and updates Committed version.
+//
+// The auxiliary state is saved under the new tree version before the tree
+// itself, so a crash in between leaves the previous version and its state
+// intact. The state of the previous version is removed afterwards.
 func (s *State) Commit(db dbm.DB) error {
-	_, version, err := s.Working.SaveVersion()
+	version := s.Working.Version() + 1
+	err := saveAuxState(db, version, auxState{
+		Height:  s.Height + 1,
+		ChainID: s.ChainID,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, savedVersion, err := s.Working.SaveVersion()
 	if err != nil {
 		return fmt.Errorf("save tree: %w", err)
 	}
+	if savedVersion != version {
+		return fmt.Errorf("saved tree version %d, expected %d", savedVersion, version)
+	}
 
 	iTree, err := s.Working.GetImmutable(version)
 	if err != nil {
@@ -79,10 +178,81 @@ func (s *State) Commit(db dbm.DB) error {
 	// Increment height.
 	s.Height++
 
-	return saveAuxState(db, auxState{
-		Height:     s.Height,
-		Validators: s.Validators,
-	})
+	if err := db.Delete(auxStateKey(version - 1)); err != nil {
+		return fmt.Errorf("delete previous state: %w", err)
+	}
+
+	return prune(s.Working, s.Pruning, s.Height)
+}
+
+// ResetCheck replaces Check with a fresh copy of Committed.
+func (s *State) ResetCheck(db dbm.DB) error {
+	tree, err := iavl.NewMutableTree(db, s.treeCacheSize)
+	if err != nil {
+		return fmt.Errorf("create check tree: %w", err)
+	}
+	// A tree is loaded from its own nodeDB, so it has to be recreated to see
+	// versions saved by Working. LazyLoadVersion can't load an empty root.
+	if s.Committed.Size() == 0 {
+		_, err = tree.LoadVersion(s.Committed.Version())
+	} else {
+		_, err = tree.LazyLoadVersion(s.Committed.Version())
+	}
+	if err != nil {
+		return fmt.Errorf("load check tree: %w", err)
+	}
+	s.Check = tree
+	return nil
+}
+
+// SetValidator adds or updates v in the working tree, or removes it if its
+// power is zero. It returns false if a validator to be removed doesn't exist.
+func (s *State) SetValidator(v *Validator) bool {
+	vss, _ := loadValidatorSet(s.Working.ImmutableTree)
+	if v.Power == 0 {
+		if !vss.Has(v) {
+			return false
+		}
+		vss.Remove(v)
+	} else {
+		vss.Set(v)
+	}
+	s.saveValidators(vss)
+	return true
+}
+
+// IncValidatorsVersion increments the version of the validator set in the
+// working tree.
+func (s *State) IncValidatorsVersion() {
+	vss, _ := loadValidatorSet(s.Working.ImmutableTree)
+	vss.Version++
+	s.saveValidators(vss)
+}
+
+func (s *State) saveValidators(vss *ValidatorSetState) {
+	saveValidatorSet(s.Working, vss)
+	s.Validators, _ = loadValidatorSet(s.Working.ImmutableTree)
+}
+
+// CommittedAt returns the committed tree as of the given height. Zero means
+// the latest committed height.
+func (s *State) CommittedAt(height int64) (*iavl.ImmutableTree, error) {
+	switch {
+	case height == 0 || height == s.Height:
+		return s.Committed, nil
+	case height < 0:
+		return nil, fmt.Errorf("negative height %d", height)
+	case height > s.Height:
+		return nil, fmt.Errorf("%w: %d (latest is %d)", ErrHeightNotCommitted, height, s.Height)
+	}
+
+	iTree, err := s.Working.GetImmutable(treeVersion(height))
+	if errors.Is(err, iavl.ErrVersionDoesNotExist) {
+		return nil, fmt.Errorf("%w: %d", ErrHeightPruned, height)
+	} else if err != nil {
+		return nil, fmt.Errorf("get immutable tree: %w", err)
+	}
+	return iTree, nil
 }
 
 // Hash returns the last committed hash.
@@ -90,25 +260,51 @@ func (s *State) Hash() []byte {
 	return s.Committed.Hash()
 }
 
+// treeVersion returns the tree version committed at the given height. The
+// initial (empty) tree is saved as version 1 at height 0.
+func treeVersion(height int64) int64 {
+	return height + 1
+}
+
+// workingHeight returns the height of the block being executed against the
+// working tree, which is the version of the last saved tree.
+func workingHeight(tree *iavl.MutableTree) int64 {
+	return tree.Version()
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
-// An auxiliary state. The main state (keys and values) is stored in an iavl tree.
+// An auxiliary state. The main state (keys, values and validators) is stored
+// in an iavl tree.
 type auxState struct {
-	Height     int64              `json:"height"`
-	Validators *ValidatorSetState `json:"validators"`
+	Height int64 `json:"height"`
+	// Validators is only set by older versions, which didn't store the
+	// validator set in the tree.
+	Validators *ValidatorSetState `json:"validators,omitempty"`
+	ChainID    string             `json:"chain_id"`
+}
+
+func auxStateKey(version int64) []byte {
+	return append(append([]byte{}, auxStatePrefix...), encodeInt64(version)...)
 }
 
-func loadAuxState(db dbm.DB) (auxState, error) {
+// loadAuxState loads the auxiliary state of the given tree version. If there
+// is none, it falls back to the state stored by older versions, as long as
+// its height matches the tree version.
+func loadAuxState(db dbm.DB, version int64) (auxState, error) {
 	// initial state
-	s := auxState{
-		Height:     0,
-		Validators: &ValidatorSetState{},
-	}
+	s := auxState{Height: 0}
 
-	bz, err := db.Get(stateKey)
+	bz, err := db.Get(auxStateKey(version))
 	if err != nil {
 		return s, fmt.Errorf("get state: %w", err)
 	}
+	if len(bz) == 0 {
+		bz, err = db.Get(stateKey)
+		if err != nil {
+			return s, fmt.Errorf("get legacy state: %w", err)
+		}
+	}
 
 	if len(bz) != 0 {
 		err = json.Unmarshal(bz, &s)
@@ -117,16 +313,56 @@ func loadAuxState(db dbm.DB) (auxState, error) {
 		}
 	}
 
+	if treeVersion(s.Height) != version {
+		return s, fmt.Errorf("%w: state is at height %d, tree at version %d (height %d)",
+			ErrStateMismatch, s.Height, version, version-1)
+	}
+
 	return s, nil
 }
 
-func saveAuxState(db dbm.DB, s auxState) error {
+// repairAuxState makes s the only auxiliary state stored. It removes the
+// states of other versions, which a crash during Commit could leave behind,
+// and migrates the legacy state.
+func repairAuxState(db dbm.DB, version int64, s auxState) error {
+	var stale [][]byte
+	it, err := db.Iterator(auxStatePrefix, prefixEnd(auxStatePrefix))
+	if err != nil {
+		return fmt.Errorf("iterate states: %w", err)
+	}
+	for ; it.Valid(); it.Next() {
+		if !bytes.Equal(it.Key(), auxStateKey(version)) {
+			stale = append(stale, it.Key())
+		}
+	}
+	if err := it.Close(); err != nil {
+		return fmt.Errorf("iterate states: %w", err)
+	}
+
+	if err := saveAuxState(db, version, s); err != nil {
+		return err
+	}
+
+	batch := db.NewBatch()
+	defer batch.Close()
+	for _, key := range append(stale, stateKey) {
+		if err := batch.Delete(key); err != nil {
+			return fmt.Errorf("delete stale state: %w", err)
+		}
+	}
+	if err := batch.WriteSync(); err != nil {
+		return fmt.Errorf("delete stale states: %w", err)
+	}
+	return nil
+}
+
+func saveAuxState(db dbm.DB, version int64, s auxState) error {
 	bz, err := json.Marshal(s)
 	if err != nil {
 		return fmt.Errorf("marshal: %w", err)
 	}
 
-	err = db.SetSync(stateKey, bz)
+	err = db.SetSync(auxStateKey(version), bz)
 	if err != nil {
 		return fmt.Errorf("set state: %w", err)
 	}
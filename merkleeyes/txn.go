@@ -0,0 +1,299 @@
+package merkleeyes
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cosmos/iavl"
+	abci "github.com/tendermint/tendermint/abci/types"
+)
+
+// Micro-operation type bytes of a TxTypeTxn transaction.
+const (
+	TxnOpRead   byte = 0x01
+	TxnOpWrite  byte = 0x02
+	TxnOpAppend byte = 0x03
+	TxnOpDelete byte = 0x04
+)
+
+// txnOp is a single micro-operation of a TxTypeTxn transaction.
+type txnOp struct {
+	typ   byte
+	key   []byte
+	value []byte // write and append only
+}
+
+func (op txnOp) String() string {
+	switch op.typ {
+	case TxnOpRead:
+		return fmt.Sprintf("r %X", op.key)
+	case TxnOpWrite:
+		return fmt.Sprintf("w %X %X", op.key, op.value)
+	case TxnOpAppend:
+		return fmt.Sprintf("append %X %X", op.key, op.value)
+	default:
+		return fmt.Sprintf("delete %X", op.key)
+	}
+}
+
+// decodeTxnOps decodes a list of micro-operations. Each one is encoded as the
+// op type byte followed by the key and, for writes and appends, the value:
+//
+//	Op | Encode(Key) [| Encode(Value)]
+//
+// An empty list decodes to an empty, non-nil slice.
+func decodeTxnOps(tx []byte) ([]txnOp, abci.ResponseDeliverTx) {
+	ops := make([]txnOp, 0)
+	for len(tx) > 0 {
+		op := txnOp{typ: tx[0]}
+		tx = tx[1:]
+
+		key, errResp, n := unmarshalBytes(tx, "key", false)
+		if key == nil {
+			return nil, errResp
+		}
+		op.key = key
+		tx = tx[n:]
+
+		switch op.typ {
+		case TxnOpRead, TxnOpDelete:
+		case TxnOpWrite, TxnOpAppend:
+			value, errResp, n := unmarshalBytes(tx, "value", false)
+			if value == nil {
+				return nil, errResp
+			}
+			op.value = value
+			tx = tx[n:]
+		default:
+			return nil, abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  fmt.Sprintf("Unexpected txn op type byte: %X", op.typ),
+			}
+		}
+
+		ops = append(ops, op)
+	}
+
+	return ops, abci.ResponseDeliverTx{}
+}
+
+// applyTxnOps applies ops in order and returns the results of the reads:
+// Encode(Value1) | Encode(Value2) | ..., where a missing key reads as an empty
+// value. Reads observe the txn's own earlier writes. Appends add Encode(Value)
+// to the current value, so an appended key reads as a list of encoded
+// elements.
+//
+// Ops are fully decoded and checked (see checkTxnOps) before being applied,
+// so either all or none of them take effect.
+func applyTxnOps(tree *iavl.MutableTree, ops []txnOp) ([]byte, error) {
+	if err := checkTxnOps(tree, ops); err != nil {
+		return nil, err
+	}
+
+	var reads []byte
+	for _, op := range ops {
+		switch op.typ {
+		case TxnOpRead:
+			_, value := tree.Get(storeKey(op.key))
+			reads = append(reads, encodeBytes(value)...)
+		case TxnOpWrite:
+			setKey(tree, op.key, op.value)
+		case TxnOpAppend:
+			_, value := tree.Get(storeKey(op.key))
+			setKey(tree, op.key, appendElement(value, op.value))
+		case TxnOpDelete:
+			_ = removeKey(tree, op.key)
+		}
+	}
+	return reads, nil
+}
+
+// checkTxnOps checks, without writing anything, that every append of ops
+// targets a list, taking the txn's own earlier writes into account.
+func checkTxnOps(tree *iavl.MutableTree, ops []txnOp) error {
+	// written holds the values written by earlier ops (nil if deleted)
+	written := make(map[string][]byte)
+	for _, op := range ops {
+		switch op.typ {
+		case TxnOpWrite:
+			written[string(op.key)] = op.value
+		case TxnOpDelete:
+			written[string(op.key)] = nil
+		case TxnOpAppend:
+			value, ok := written[string(op.key)]
+			if !ok {
+				_, value = tree.Get(storeKey(op.key))
+			}
+			if _, err := decodeList(value); err != nil {
+				return fmt.Errorf("value of %X is not a list: %w", op.key, err)
+			}
+			written[string(op.key)] = appendElement(value, op.value)
+		}
+	}
+	return nil
+}
+
+// writtenKeys returns the keys written, appended to or deleted by ops.
+func writtenKeys(ops []txnOp) [][]byte {
+	var keys [][]byte
+	for _, op := range ops {
+		if op.typ != TxnOpRead {
+			keys = append(keys, op.key)
+		}
+	}
+	return keys
+}
+
+// Guard type bytes of a TxTypeCondTxn transaction.
+const (
+	GuardValueEquals byte = 0x01
+	GuardExists      byte = 0x02
+	GuardMissing     byte = 0x03
+)
+
+// Branch bytes, which prefix the result data of a TxTypeCondTxn transaction.
+const (
+	CondTxnElse byte = 0x00
+	CondTxnThen byte = 0x01
+)
+
+// guard is a condition on a single key.
+type guard struct {
+	typ   byte
+	key   []byte
+	value []byte // value equals only
+}
+
+func (g guard) String() string {
+	switch g.typ {
+	case GuardValueEquals:
+		return fmt.Sprintf("%X = %X", g.key, g.value)
+	case GuardExists:
+		return fmt.Sprintf("%X exists", g.key)
+	default:
+		return fmt.Sprintf("%X missing", g.key)
+	}
+}
+
+// holds returns true if the guard holds in tree.
+func (g guard) holds(tree *iavl.MutableTree) bool {
+	_, value := tree.Get(storeKey(g.key))
+	switch g.typ {
+	case GuardValueEquals:
+		return bytes.Equal(value, g.value)
+	case GuardExists:
+		return value != nil
+	default:
+		return value == nil
+	}
+}
+
+// decodeGuards decodes a list of guards, each encoded as:
+//
+//	Guard | Encode(Key) [| Encode(Value)]
+func decodeGuards(tx []byte) ([]guard, abci.ResponseDeliverTx) {
+	guards := make([]guard, 0)
+	for len(tx) > 0 {
+		g := guard{typ: tx[0]}
+		tx = tx[1:]
+
+		key, errResp, n := unmarshalBytes(tx, "key", false)
+		if key == nil {
+			return nil, errResp
+		}
+		g.key = key
+		tx = tx[n:]
+
+		switch g.typ {
+		case GuardExists, GuardMissing:
+		case GuardValueEquals:
+			value, errResp, n := unmarshalBytes(tx, "value", false)
+			if value == nil {
+				return nil, errResp
+			}
+			g.value = value
+			tx = tx[n:]
+		default:
+			return nil, abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  fmt.Sprintf("Unexpected guard type byte: %X", g.typ),
+			}
+		}
+
+		guards = append(guards, g)
+	}
+
+	return guards, abci.ResponseDeliverTx{}
+}
+
+// condTxn is a TxTypeCondTxn transaction: if all guards hold, the ops of the
+// then branch are applied, otherwise the ops of the else branch.
+type condTxn struct {
+	guards  []guard
+	thenOps []txnOp
+	elseOps []txnOp
+}
+
+// decodeCondTxn decodes a conditional transaction:
+//
+//	Encode(Guards) | Encode(ThenOps) | Encode(ElseOps)
+//
+// Each of the lists may be empty.
+func decodeCondTxn(tx []byte) (*condTxn, abci.ResponseDeliverTx) {
+	var lists [3][]byte
+	for i, name := range []string{"guards", "then", "else"} {
+		list, n, err := decodeBytes(tx)
+		if err != nil {
+			return nil, abci.ResponseDeliverTx{
+				Code: CodeTypeEncodingError,
+				Log:  fmt.Sprintf("Can't decode %s: %v", name, err),
+			}
+		}
+		lists[i] = list
+		tx = tx[n:]
+	}
+	if len(tx) > 0 {
+		return nil, abci.ResponseDeliverTx{Code: CodeTypeEncodingError, Log: "Got bytes left over"}
+	}
+
+	var (
+		ct      condTxn
+		errResp abci.ResponseDeliverTx
+	)
+	if ct.guards, errResp = decodeGuards(lists[0]); ct.guards == nil {
+		return nil, errResp
+	}
+	if ct.thenOps, errResp = decodeTxnOps(lists[1]); ct.thenOps == nil {
+		return nil, errResp
+	}
+	if ct.elseOps, errResp = decodeTxnOps(lists[2]); ct.elseOps == nil {
+		return nil, errResp
+	}
+
+	return &ct, abci.ResponseDeliverTx{}
+}
+
+// writtenKeys returns the keys which may be written by either branch.
+func (ct *condTxn) writtenKeys() [][]byte {
+	return append(writtenKeys(ct.thenOps), writtenKeys(ct.elseOps)...)
+}
+
+// apply evaluates the guards and applies the ops of the chosen branch. It
+// returns whether the then branch was chosen and the reads of the branch (see
+// applyTxnOps).
+func (ct *condTxn) apply(tree *iavl.MutableTree) (succeeded bool, reads []byte, err error) {
+	succeeded = true
+	for _, g := range ct.guards {
+		if !g.holds(tree) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := ct.elseOps
+	if succeeded {
+		ops = ct.thenOps
+	}
+	reads, err = applyTxnOps(tree, ops)
+	return succeeded, reads, err
+}
@@ -0,0 +1,64 @@
+package merkleeyes
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cosmos/iavl"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+)
+
+// The validator set is stored in the tree, so it's covered by the app hash:
+// each validator's power under its pubkey and the version of the set
+// separately.
+
+var (
+	validatorPrefix  = []byte("/val/")
+	valsetVersionKey = []byte("/valset/version")
+)
+
+// validatorKey maps a validator's pubkey to its power.
+func validatorKey(pubKey []byte) []byte {
+	return append(append([]byte{}, validatorPrefix...), pubKey...)
+}
+
+// loadValidatorSet reads the validator set from tree, ordered by pubkey. The
+// second return value is false if the tree contains no validator set yet.
+func loadValidatorSet(tree *iavl.ImmutableTree) (*ValidatorSetState, bool) {
+	vss := &ValidatorSetState{}
+
+	_, bz := tree.Get(valsetVersionKey)
+	found := bz != nil
+	if found {
+		vss.Version = binary.BigEndian.Uint64(bz)
+	}
+
+	tree.IterateRange(validatorPrefix, prefixEnd(validatorPrefix), true, func(key, value []byte) bool {
+		found = true
+		vss.Validators = append(vss.Validators, &Validator{
+			PubKey: ed25519.PubKey(append([]byte{}, key[len(validatorPrefix):]...)),
+			Power:  int64(binary.BigEndian.Uint64(value)),
+		})
+		return false
+	})
+
+	return vss, found
+}
+
+// saveValidatorSet writes vss to tree, replacing the validator set stored
+// there.
+func saveValidatorSet(tree *iavl.MutableTree, vss *ValidatorSetState) {
+	stored, _ := loadValidatorSet(tree.ImmutableTree)
+	for _, v := range stored.Validators {
+		if !vss.Has(v) {
+			_, _ = tree.Remove(validatorKey(v.PubKey))
+		}
+	}
+	for _, v := range vss.Validators {
+		if v.Power == 0 {
+			panic(fmt.Sprintf("validator %X with zero power", v.PubKey.Bytes()))
+		}
+		_ = tree.Set(validatorKey(v.PubKey), encodeInt64(v.Power))
+	}
+	_ = tree.Set(valsetVersionKey, encodeInt64(int64(vss.Version)))
+}